@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/directory"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// snapshot is the last complete copy of the directory
+type snapshot struct {
+	passwd []nssStructs.Passwd
+	group  []nssStructs.Group
+	shadow []nssStructs.Shadow
+	synced time.Time
+}
+
+// daemon holds the confidential client and the synced directory
+type daemon struct {
+	config *conf.Config
+	//Delta sync state, only used by the sync loop
+	state     *directory.State
+	statePath string
+
+	mu   sync.RWMutex
+	snap *snapshot
+	//Live lookups that found nothing, by request
+	misses map[string]time.Time
+	//Live lookups made for callers other than root
+	liveLimit limiter
+}
+
+func newDaemon(config *conf.Config, statePath string) *daemon {
+	state, err := directory.LoadState(statePath)
+	if err != nil {
+		errorLog.Println("Discarding unreadable sync state:", err)
+		state = directory.NewState()
+	}
+	return &daemon{config: config, state: state, statePath: statePath}
+}
+
+// directory returns a directory client with a fresh token, allowed to write
+// UIDs and GIDs to Azure AD when writable is set
+func (d *daemon) directory(writable bool) (*directory.Directory, error) {
+	token, err := directory.Token(d.config, "/var/tmp/"+app+"_"+fmt.Sprint(os.Getuid())+"_.json")
+	if err != nil {
+		return nil, err
+	}
+	return directory.New(d.config, token, writable), nil
+}
+
+// syncLoop syncs immediately, then every interval or when resync fires
+func (d *daemon) syncLoop(interval time.Duration, resync <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.sync(); err != nil {
+			errorLog.Println("Sync failed:", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-resync:
+			//Drop the delta links so the next sync is a full one
+			infoLog.Println("Full resync requested")
+			d.state.UserDeltaLink = ""
+			d.state.GroupDeltaLink = ""
+		}
+	}
+}
+
+// sync fetches directory changes and rebuilds the snapshot from the sync state
+func (d *daemon) sync() error {
+	start := time.Now()
+	dir, err := d.directory(true)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(d.state); err != nil {
+		return err
+	}
+	passwd := dir.PasswdFromState(d.state)
+	group := append(dir.GroupFromState(d.state), dir.PrivateGroups(passwd)...)
+	shadow := dir.ShadowFromState(d.state)
+
+	//Report IDs shadowed by, or shadowing, local accounts on this host
+	if clashes, err := directory.LocalClashes(passwd, group); err != nil {
+		errorLog.Println("Unable to check for clashes with local accounts:", err)
+	} else {
+		for _, c := range clashes {
+			warnLog.Println(c)
+		}
+	}
+
+	//Keep the state so a restart carries on from the last delta links
+	if err := d.state.Save(d.statePath); err != nil {
+		errorLog.Println("Unable to save sync state:", err)
+	}
+
+	d.mu.Lock()
+	d.snap = &snapshot{passwd: passwd, group: group, shadow: shadow, synced: d.state.Synced}
+	d.misses = map[string]time.Time{}
+	d.mu.Unlock()
+	infoLog.Printf("Synced %d users and %d groups in %v", len(passwd), len(group), time.Since(start))
+	return nil
+}
+
+// addPasswd records an entry found by a live lookup so later lookups are answered locally
+func (d *daemon) addPasswd(p nssStructs.Passwd) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.snap == nil {
+		return
+	}
+	for i := range d.snap.passwd {
+		if d.snap.passwd[i].Username == p.Username {
+			d.snap.passwd[i] = p
+			return
+		}
+	}
+	d.snap.passwd = append(d.snap.passwd, p)
+}
+
+// addGroup records a group found by a live lookup so later lookups are answered locally
+func (d *daemon) addGroup(g nssStructs.Group) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.snap == nil {
+		return
+	}
+	for i := range d.snap.group {
+		if d.snap.group[i].Groupname == g.Groupname {
+			d.snap.group[i] = g
+			return
+		}
+	}
+	d.snap.group = append(d.snap.group, g)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/directory"
+	"github.com/datty/pam-azuread/internal/logger"
+	"github.com/datty/pam-azuread/internal/syncd"
+)
+
+// app name
+const app = "azuread-syncd"
+
+// Default seconds between directory syncs
+const defaultSyncInterval = 300
+
+// Default path of the delta sync state
+const defaultStateFile = "/var/lib/azuread/syncd-state.json"
+
+var debugLog = logger.Debug
+var infoLog = logger.Info
+var warnLog = logger.Warn
+var errorLog = logger.Error
+
+func main() {
+	reportClashes := flag.Bool("report-clashes", false, "list AzureAD UIDs/GIDs that clash with local accounts and groups on this host, then exit")
+	flag.Parse()
+
+	logger.Init(app)
+
+	if os.Getuid() != 0 {
+		fmt.Fprintln(os.Stderr, app+" must be run as root")
+		os.Exit(1)
+	}
+
+	config, err := conf.ReadConfig()
+	if err != nil {
+		errorLog.Println("unable to read configfile:", err)
+		os.Exit(1)
+	}
+	secrets, err := conf.ReadSecrets()
+	if err != nil {
+		errorLog.Println("unable to read secretsfile:", err)
+		os.Exit(1)
+	}
+	//The daemon always holds the privileged credentials
+	config.ClientID = secrets.ClientID
+	config.ClientSecret = secrets.ClientSecret
+
+	if *reportClashes {
+		os.Exit(report(config))
+	}
+
+	interval := time.Duration(config.SyncdInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultSyncInterval * time.Second
+	}
+	socket := config.SyncdSocket
+	if socket == "" {
+		socket = syncd.DefaultSocket
+	}
+
+	stateFile := config.SyncdStateFile
+	if stateFile == "" {
+		stateFile = defaultStateFile
+	}
+
+	d := newDaemon(config, stateFile)
+
+	listener, err := listen(socket)
+	if err != nil {
+		errorLog.Println("unable to listen on", socket, err)
+		os.Exit(1)
+	}
+	infoLog.Println("Listening on", socket)
+
+	//Sync on a schedule, and on demand with SIGHUP
+	resync := make(chan os.Signal, 1)
+	signal.Notify(resync, syscall.SIGHUP)
+	go d.syncLoop(interval, resync)
+
+	//Remove the socket on shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		infoLog.Println("Shutting down")
+		listener.Close()
+	}()
+
+	d.serve(listener)
+	os.Remove(socket)
+}
+
+// listen opens the lookup socket, readable and writable by every local user
+func listen(socket string) (*net.UnixListener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return nil, err
+	}
+	//Remove a stale socket left by an earlier run
+	os.Remove(socket)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0666); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// report prints the AzureAD users and groups whose IDs are also used by local
+// accounts or groups on this host. Nothing is written to AzureAD.
+func report(config *conf.Config) int {
+	token, err := directory.Token(config, "/var/tmp/"+app+"_"+fmt.Sprint(os.Getuid())+"_.json")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to get token:", err)
+		return 2
+	}
+	dir := directory.New(config, token, false)
+	passwd, err := dir.PasswdAll()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to list users:", err)
+		return 2
+	}
+	group, err := dir.GroupAll()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to list groups:", err)
+		return 2
+	}
+	clashes, err := directory.LocalClashes(passwd, group)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to read local accounts:", err)
+		return 2
+	}
+	for _, c := range clashes {
+		fmt.Println(c)
+	}
+	if len(clashes) != 0 {
+		return 1
+	}
+	fmt.Println("No clashes with local accounts or groups")
+	return 0
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/directory"
+	"github.com/datty/pam-azuread/internal/syncd"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// How long a single client connection may take
+const connTimeout = 30 * time.Second
+
+// How long a name or ID missing from Azure AD is remembered before asking again
+const negativeTTL = 60 * time.Second
+
+// Live lookups callers other than root may make, per second and in a burst
+const (
+	liveRate  = 2
+	liveBurst = 20
+)
+
+// limiter is a token bucket, the zero value starts full
+type limiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is left
+func (l *limiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = liveBurst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * liveRate
+		if l.tokens > liveBurst {
+			l.tokens = liveBurst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// serve answers lookups until the listener is closed
+func (d *daemon) serve(l *net.UnixListener) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			errorLog.Println("Accept failed:", err)
+			continue
+		}
+		go d.handleConn(conn)
+	}
+}
+
+// handleConn reads one request and writes its response
+func (d *daemon) handleConn(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connTimeout))
+
+	var req syncd.Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		debugLog.Println("Invalid request:", err)
+		return
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		errorLog.Println("Unable to read peer credentials:", err)
+		return
+	}
+	res := d.handle(req, uid == 0)
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		debugLog.Println("Unable to send response:", err)
+	}
+}
+
+// peerUID returns the UID of the process on the other end of conn
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+// handle answers a request from the snapshot, falling back to a live lookup for
+// single entries that have appeared since the last sync. Shadow entries are only
+// returned to root, and only lookups made by root may allocate UIDs and GIDs in
+// Azure AD. Live lookups for everyone else are rate limited.
+func (d *daemon) handle(req syncd.Request, privileged bool) syncd.Response {
+	d.mu.RLock()
+	snap := d.snap
+	d.mu.RUnlock()
+
+	switch req.Op {
+	case syncd.OpPasswdAll:
+		if snap == nil {
+			return syncd.Response{Status: directory.StatusUnavail}
+		}
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return syncd.Response{Passwd: append([]nssStructs.Passwd{}, snap.passwd...)}
+
+	case syncd.OpPasswdByName, syncd.OpPasswdByUid:
+		if p, ok := d.findPasswd(req); ok {
+			return syncd.Response{Passwd: []nssStructs.Passwd{p}}
+		}
+		return d.live(req, privileged, func(dir *directory.Directory) (syncd.Response, error) {
+			var p nssStructs.Passwd
+			var err error
+			if req.Op == syncd.OpPasswdByName {
+				p, err = dir.PasswdByName(req.Name)
+			} else {
+				p, err = dir.PasswdByUid(req.ID)
+			}
+			if err == nil {
+				d.addPasswd(p)
+			}
+			return syncd.Response{Passwd: []nssStructs.Passwd{p}}, err
+		})
+
+	case syncd.OpGroupAll:
+		if snap == nil {
+			return syncd.Response{Status: directory.StatusUnavail}
+		}
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return syncd.Response{Group: append([]nssStructs.Group{}, snap.group...)}
+
+	case syncd.OpGroupByName, syncd.OpGroupByGid:
+		if g, ok := d.findGroup(req); ok {
+			return syncd.Response{Group: []nssStructs.Group{g}}
+		}
+		return d.live(req, privileged, func(dir *directory.Directory) (syncd.Response, error) {
+			var g nssStructs.Group
+			var err error
+			if req.Op == syncd.OpGroupByName {
+				g, err = dir.GroupByName(req.Name)
+			} else {
+				g, err = dir.GroupByGid(req.ID)
+			}
+			if err == nil {
+				d.addGroup(g)
+			}
+			return syncd.Response{Group: []nssStructs.Group{g}}, err
+		})
+
+	case syncd.OpInitGroups:
+		if gids, ok := d.findGroupsOf(req.Name); ok {
+			return syncd.Response{GIDs: gids}
+		}
+		return d.live(req, privileged, func(dir *directory.Directory) (syncd.Response, error) {
+			gids, err := dir.InitGroups(req.Name)
+			return syncd.Response{GIDs: gids}, err
+		})
+
+	case syncd.OpShadowAll:
+		if !privileged || snap == nil {
+			return syncd.Response{Status: directory.StatusUnavail}
+		}
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return syncd.Response{Shadow: append([]nssStructs.Shadow{}, snap.shadow...)}
+
+	case syncd.OpShadowByName:
+		if !privileged {
+			return syncd.Response{Status: directory.StatusUnavail}
+		}
+		if s, ok := d.findShadow(req.Name); ok {
+			return syncd.Response{Shadow: []nssStructs.Shadow{s}}
+		}
+		return d.live(req, privileged, func(dir *directory.Directory) (syncd.Response, error) {
+			s, err := dir.ShadowByName(req.Name)
+			return syncd.Response{Shadow: []nssStructs.Shadow{s}}, err
+		})
+	}
+	debugLog.Println("Unknown operation:", req.Op)
+	return syncd.Response{Status: directory.StatusUnavail}
+}
+
+// live runs a lookup against Azure AD, remembering misses for negativeTTL.
+// Lookups made by unprivileged callers are read only and limited to liveRate
+// a second, so they cannot write to Azure AD or flood it with requests.
+func (d *daemon) live(req syncd.Request, privileged bool, fn func(*directory.Directory) (syncd.Response, error)) syncd.Response {
+	key := fmt.Sprintf("%s/%s/%d", req.Op, req.Name, req.ID)
+	d.mu.Lock()
+	if d.misses == nil {
+		d.misses = map[string]time.Time{}
+	}
+	missed, ok := d.misses[key]
+	d.mu.Unlock()
+	if ok && time.Since(missed) < negativeTTL {
+		return syncd.Response{Status: directory.StatusNotFound}
+	}
+
+	if !privileged && !d.liveLimit.allow(time.Now()) {
+		debugLog.Println("Live lookup rate limited:", key)
+		return syncd.Response{Status: directory.StatusTryAgain}
+	}
+
+	dir, err := d.directory(privileged)
+	if err != nil {
+		return syncd.Response{Status: directory.StatusOf(err)}
+	}
+	res, err := fn(dir)
+	if err != nil {
+		res = syncd.Response{Status: directory.StatusOf(err)}
+		if res.Status == directory.StatusNotFound {
+			d.mu.Lock()
+			d.misses[key] = time.Now()
+			d.mu.Unlock()
+		}
+	}
+	return res
+}
+
+// findPasswd looks up a user by name or UID in the snapshot
+func (d *daemon) findPasswd(req syncd.Request) (nssStructs.Passwd, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.snap == nil {
+		return nssStructs.Passwd{}, false
+	}
+	for _, p := range d.snap.passwd {
+		if (req.Op == syncd.OpPasswdByName && p.Username == req.Name) ||
+			(req.Op == syncd.OpPasswdByUid && p.UID == req.ID && p.UID != directory.NobodyID) {
+			return p, true
+		}
+	}
+	return nssStructs.Passwd{}, false
+}
+
+// findGroup looks up a group by name or GID in the snapshot
+func (d *daemon) findGroup(req syncd.Request) (nssStructs.Group, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.snap == nil {
+		return nssStructs.Group{}, false
+	}
+	for _, g := range d.snap.group {
+		if (req.Op == syncd.OpGroupByName && g.Groupname == req.Name) ||
+			(req.Op == syncd.OpGroupByGid && g.GID == req.ID) {
+			return g, true
+		}
+	}
+	return nssStructs.Group{}, false
+}
+
+// findShadow looks up a shadow entry by name in the snapshot
+func (d *daemon) findShadow(name string) (nssStructs.Shadow, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.snap == nil {
+		return nssStructs.Shadow{}, false
+	}
+	for _, s := range d.snap.shadow {
+		if s.Username == name {
+			return s, true
+		}
+	}
+	return nssStructs.Shadow{}, false
+}
+
+// findGroupsOf returns the GIDs of the snapshot groups a user in the snapshot belongs to
+func (d *daemon) findGroupsOf(name string) ([]uint, bool) {
+	if _, ok := d.findPasswd(syncd.Request{Op: syncd.OpPasswdByName, Name: name}); !ok {
+		return nil, false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	gids := []uint{}
+	for _, g := range d.snap.group {
+		for _, member := range g.Members {
+			if member == name {
+				gids = append(gids, g.GID)
+				break
+			}
+		}
+	}
+	return gids, true
+}
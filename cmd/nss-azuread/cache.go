@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/datty/pam-azuread/internal/cache"
+	"github.com/datty/pam-azuread/internal/directory"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+var dirCache *cache.Cache
+
+// directoryCache returns the on-disk cache, or nil when caching is disabled
+func directoryCache() *cache.Cache {
+	if dirCache == nil {
+		dirCache = cache.ForConfig(config)
+		if dirCache != nil {
+			dirCache.IsNotFound = directory.IsNotFound
+		}
+	}
+	return dirCache
+}
+
+// lookup answers from the cache when enabled, otherwise calls fetch directly.
+// azuread-syncd keeps its own copy of the directory so is never cached here.
+// out must be a pointer to the type fetch returns.
+func (self LibNssOauth) lookup(db string, key string, out interface{}, fetch cache.Fetcher) error {
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	if c := directoryCache(); c != nil && !config.SyncdEnabled {
+		return c.Lookup(db, key, out, fetch)
+	}
+	value, err := fetch()
+	if err != nil {
+		return err
+	}
+	reflect.ValueOf(out).Elem().Set(reflect.ValueOf(value))
+	return nil
+}
+
+// seed stores entries found while enumerating so single lookups can use them
+func (self LibNssOauth) seed(db string, entries map[string]interface{}) {
+	c := directoryCache()
+	if c == nil || !isroot || config.SyncdEnabled {
+		return
+	}
+	if err := c.Put(db, entries); err != nil {
+		debugLog.Println("Unable to update cache:", err)
+	}
+}
+
+// seedPasswd caches enumerated users by name and UID
+func (self LibNssOauth) seedPasswd(entries []nssStructs.Passwd) {
+	seed := map[string]interface{}{}
+	for _, p := range entries {
+		//Users without a UID cannot be resolved on their own
+		if p.UID == directory.NobodyID {
+			continue
+		}
+		seed["name:"+p.Username] = p
+		seed["uid:"+fmt.Sprint(p.UID)] = p
+	}
+	self.seed(cache.Passwd, seed)
+}
+
+// seedGroup caches enumerated groups by name and GID
+func (self LibNssOauth) seedGroup(entries []nssStructs.Group) {
+	seed := map[string]interface{}{}
+	for _, g := range entries {
+		seed["name:"+g.Groupname] = g
+		seed["gid:"+fmt.Sprint(g.GID)] = g
+	}
+	self.seed(cache.Group, seed)
+}
+
+// seedShadow caches enumerated shadow entries by name
+func (self LibNssOauth) seedShadow(entries []nssStructs.Shadow) {
+	seed := map[string]interface{}{}
+	for _, s := range entries {
+		seed["name:"+s.Username] = s
+	}
+	self.seed(cache.Shadow, seed)
+}
@@ -0,0 +1,59 @@
+#include <errno.h>
+#include <grp.h>
+#include <nss.h>
+#include <stdlib.h>
+#include <sys/types.h>
+#include "_cgo_export.h"
+
+// go-libnss has no initgroups, name it the same way as the functions it exports
+#ifndef __LIB_NSS_NAME
+#define __LIB_NSS_NAME gonss
+#endif
+#define __XPASTER(x,y,z) x ## y ## _ ## z
+#define __PASTER(x,y,z) __XPASTER(x,y,z)
+#define __FNAME(x) __PASTER(_nss_, __LIB_NSS_NAME, x)
+
+// Append gid to the list glibc passed in, growing it up to limit.
+// Returns 1 when added or skipped, 0 once the list is full and -1 when it
+// cannot grow.
+int add_group(gid_t gid, gid_t group, long int *start, long int *size,
+              gid_t **groupsp, long int limit, int *errnop) {
+  long int i;
+  if (gid == group) {
+    return 1;
+  }
+  for (i = 0; i < *start; i++) {
+    if ((*groupsp)[i] == gid) {
+      return 1;
+    }
+  }
+  if (*start == *size) {
+    long int newsize = *size > 0 ? *size * 2 : 16;
+    gid_t *groups;
+    if (limit > 0) {
+      if (*size >= limit) {
+        return 0;
+      }
+      if (newsize > limit) {
+        newsize = limit;
+      }
+    }
+    groups = realloc(*groupsp, newsize * sizeof(gid_t));
+    if (!groups) {
+      *errnop = ENOMEM;
+      return -1;
+    }
+    *groupsp = groups;
+    *size = newsize;
+  }
+  (*groupsp)[(*start)++] = gid;
+  return 1;
+}
+
+enum nss_status __FNAME(initgroups_dyn)(const char *user, gid_t group,
+                                        long int *start, long int *size,
+                                        gid_t **groupsp, long int limit,
+                                        int *errnop) {
+  return go_initgroups_dyn((char *)user, group, start, size, groupsp, limit,
+                           errnop);
+}
@@ -0,0 +1,44 @@
+package main
+
+/*
+#include <nss.h>
+#include <sys/types.h>
+int add_group(gid_t gid, gid_t group, long int *start, long int *size, gid_t **groupsp, long int limit, int *errnop);
+*/
+import "C"
+
+import (
+	"syscall"
+
+	nss "github.com/protosam/go-libnss"
+)
+
+// go_initgroups_dyn adds the GIDs of user's groups to the list glibc passed
+// to _nss_azuread_initgroups_dyn, see initgroups.c. user is copied, stale
+// cache entries are refreshed after this returns and glibc may free it.
+//
+//export go_initgroups_dyn
+func go_initgroups_dyn(user *C.char, group C.gid_t, start *C.long, size *C.long, groupsp **C.gid_t, limit C.long, errnop *C.int) C.enum_nss_status {
+	status, gids := LibNssOauth{}.InitGroups(C.GoString(user))
+	switch status {
+	case nss.StatusSuccess:
+	case nss.StatusTryagain:
+		//errno as the go-libnss lookups set it, the failure is temporary
+		*errnop = C.int(syscall.EAGAIN)
+		return C.enum_nss_status(status)
+	default:
+		//Not found, or Azure AD unavailable
+		*errnop = C.int(syscall.ENOENT)
+		return C.enum_nss_status(status)
+	}
+	for _, gid := range gids {
+		switch C.add_group(C.gid_t(gid), group, start, size, groupsp, limit, errnop) {
+		case 0:
+			//Full, glibc keeps the groups it has
+			return C.NSS_STATUS_SUCCESS
+		case -1:
+			return C.NSS_STATUS_TRYAGAIN
+		}
+	}
+	return C.NSS_STATUS_SUCCESS
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/datty/pam-azuread/internal/directory"
+
+	nss "github.com/protosam/go-libnss"
+)
+
+// nssStatus converts directory.StatusOf to the go-libnss status it is returned as
+func nssStatus(err error) nss.Status {
+	switch directory.StatusOf(err) {
+	case directory.StatusSuccess:
+		return nss.StatusSuccess
+	case directory.StatusNotFound:
+		return nss.StatusNotfound
+	case directory.StatusTryAgain:
+		return nss.StatusTryagain
+	default:
+		return nss.StatusUnavail
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+//#include <security/pam_appl.h>
+import "C"
+import (
+	"errors"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/cache"
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/directory"
+	"github.com/datty/pam-azuread/internal/offline"
+	"github.com/datty/pam-azuread/internal/syncd"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// pamAcctMgmt decides whether username may log in to this host. Users
+// disabled in AzureAD are refused, then access-allow-groups,
+// access-deny-groups and access-app-roles are checked.
+func pamAcctMgmt(pamh *C.pam_handle_t, flags int, username string) int {
+	config, err := conf.ReadConfig()
+	if err != nil {
+		pamLog("Error reading config: %v", err)
+		return PAM_OPEN_ERR
+	}
+
+	store := offlineStore(config)
+	allowed, reason, err := directory.CheckAccess(config, username)
+	if errors.Is(err, directory.ErrAccountDisabled) {
+		pamLog("Account disabled in AzureAD for user: %s", username)
+		forgetOffline(store, username)
+		sendError(pamh, flags, "Your account has been disabled, contact your administrator")
+		return PAM_ACCT_EXPIRED
+	}
+	if err != nil {
+		if errors.Is(err, directory.ErrLocalUser) {
+			return PAM_USER_UNKNOWN
+		}
+		if directory.IsNotFound(err) {
+			pamLog("No AzureAD user for login name: %s", username)
+			return PAM_USER_UNKNOWN
+		}
+		if unreachable(err) {
+			return localAccess(pamh, flags, config, store, username, err)
+		}
+		pamLog("Unable to check access for user: %s. Error: %v", username, err)
+		return PAM_AUTHINFO_UNAVAIL
+	}
+
+	if !allowed {
+		pamLog("Access denied for user: %s, %s", username, reason)
+		//A refused user must not get in offline either
+		forgetOffline(store, username)
+		sendError(pamh, flags, "Access denied: "+username+" is not allowed to log in to this host")
+		return PAM_PERM_DENIED
+	}
+	return PAM_SUCCESS
+}
+
+// localAccess decides while AzureAD is unreachable, from what this host
+// already holds. Users known to be disabled are refused whatever else is
+// cached. Not every login authenticates against AzureAD first, public keys
+// do not, so without an offline login or a local copy showing the account
+// enabled the user is refused.
+func localAccess(pamh *C.pam_handle_t, flags int, config *conf.Config, store *offline.Store, username string, graphErr error) int {
+	enabled, known := localAccount(config, username, graphErr)
+	if known && !enabled {
+		pamLog("AzureAD unreachable, account disabled for user: %s", username)
+		forgetOffline(store, username)
+		sendError(pamh, flags, "Your account has been disabled, contact your administrator")
+		return PAM_ACCT_EXPIRED
+	}
+	if store != nil {
+		return offlineAccess(store, username)
+	}
+	if known && !directory.AccessRestricted(config) {
+		pamLog("AzureAD unreachable, allowing user enabled in local copy: %s", username)
+		return PAM_SUCCESS
+	}
+	pamLog("AzureAD unreachable, unable to check access for user: %s. Error: %v", username, graphErr)
+	return PAM_AUTHINFO_UNAVAIL
+}
+
+// localAccount looks up whether username is enabled in AzureAD in the shadow
+// entry kept by azuread-syncd or in the NSS cache, known is false when
+// neither has one. Entries of disabled users have expired.
+func localAccount(config *conf.Config, username string, graphErr error) (enabled bool, known bool) {
+	var shadow nssStructs.Shadow
+	if config.SyncdEnabled {
+		res, err := syncd.NewClient(config.SyncdSocket).Do(syncd.Request{Op: syncd.OpShadowByName, Name: username})
+		if err != nil || res.Status != directory.StatusSuccess || len(res.Shadow) != 1 {
+			return false, false
+		}
+		shadow = res.Shadow[0]
+	} else if c := cache.ForConfig(config); c != nil {
+		//Cached entries are only served within cache-offline-ttl, as NSS serves them
+		err := c.Lookup(cache.Shadow, "name:"+username, &shadow, func() (interface{}, error) {
+			return nil, graphErr
+		})
+		if err != nil {
+			return false, false
+		}
+	} else {
+		return false, false
+	}
+	return !expired(shadow), true
+}
+
+// expired reports whether the account of a shadow entry has expired
+func expired(s nssStructs.Shadow) bool {
+	return s.ExpirationDate > 0 && int64(s.ExpirationDate) <= time.Now().Unix()/86400
+}
+
+// offlineAccess lets users in while AzureAD is unreachable only if they
+// could log in offline: their verifier is only saved by an online login
+// and is removed when they are refused access
+func offlineAccess(store *offline.Store, username string) int {
+	if err := store.Usable(username); err != nil {
+		pamLog("AzureAD unreachable, unable to check access for user: %s. Error: %v", username, err)
+		return PAM_AUTHINFO_UNAVAIL
+	}
+	pamLog("AzureAD unreachable, allowing user with offline verifier: %s", username)
+	return PAM_SUCCESS
+}
+
+// forgetOffline removes the offline verifier of a refused user
+func forgetOffline(store *offline.Store, username string) {
+	if store == nil {
+		return
+	}
+	if err := store.Forget(username); err != nil {
+		pamLog("Unable to remove offline verifier for user: %s. Error: %v", username, err)
+	}
+}
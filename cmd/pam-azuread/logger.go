@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/datty/pam-azuread/internal/logger"
+)
+
+//Send the logs of the internal packages to syslog, pamLog writes there already
+func init() {
+	logger.Init(app)
+}
@@ -32,6 +32,7 @@ import (
 	"log/syslog"
 
 	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/directory"
 
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/public"
 	"gopkg.in/square/go-jose.v2/jwt"
@@ -60,31 +61,60 @@ func pamAuthenticate(pamh *C.pam_handle_t, uid int, username string, argv []stri
 	password := strings.TrimSpace(requestPass(pamh, C.PAM_PROMPT_ECHO_OFF, "AzureAD-Password: "))
 
 	//Open AzureAD
-	app, err := public.New(config.ClientID, public.WithAuthority("https://login.microsoftonline.com/"+config.TenantID))
+	app, err := public.New(config.ClientID, public.WithAuthority(config.Authority()))
 	if err != nil {
 		pamLog("Error opening AzureAD connection: %v", err)
 		return PAM_OPEN_ERR
 	}
 
+	store := offlineStore(config)
+
+	//Find the UPN the login name belongs to
+	upn, err := loginUPN(config, username)
+	if err != nil {
+		if directory.IsNotFound(err) {
+			pamLog("No AzureAD user for login name: %s", username)
+			return PAM_USER_UNKNOWN
+		}
+		if store != nil && unreachable(err) {
+			return offlineAuthenticate(store, username, password)
+		}
+		pamLog("Unable to look up AzureAD user for login name: %s. Error: %v", username, err)
+		return PAM_AUTHINFO_UNAVAIL
+	}
+
 	//Auth with Username/Password
-	pamLog("Attempting token auth for user: %s", fmt.Sprintf(config.Domain, username))
+	pamLog("Attempting token auth for user: %s", upn)
 	result, err := app.AcquireTokenByUsernamePassword(
 		context.Background(),
 		config.PamScopes,
-		fmt.Sprintf(config.Domain, username),
+		upn,
 		password,
 	)
 	if err != nil {
-		pamLog("AzureAD authentication failed for user: %s. Error: %v", fmt.Sprintf(config.Domain, username), err)
+		//Fall back to the offline verifier only when AzureAD could not answer
+		if store != nil && unreachable(err) {
+			return offlineAuthenticate(store, username, password)
+		}
+		if accountDisabled(err) {
+			forgetOffline(store, username)
+		}
+		pamLog("AzureAD authentication failed for user: %s. Error: %v", upn, err)
 		return PAM_AUTH_ERR
 	}
 
 	// check token is valid
 	if validateToken(result.AccessToken) {
-		pamLog("AzureAD authentication succeeded for user: %s", fmt.Sprintf(config.Domain, username))
+		pamLog("AzureAD authentication succeeded for user: %s", upn)
+		//Remember the password for offline logins, only once AzureAD has accepted it
+		if store != nil {
+			if err := store.Save(username, password); err != nil {
+				pamLog("Unable to save offline verifier for user: %s. Error: %v", username, err)
+			}
+		}
 		return PAM_SUCCESS
 	} else {
-		pamLog("AzureAD token invalid, authentication failed for user: %s", fmt.Sprintf(config.Domain, username))
+		pamLog("AzureAD token invalid, authentication failed for user: %s", upn)
 		return PAM_AUTH_ERR
 	}
 
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/directory"
+	"github.com/datty/pam-azuread/internal/offline"
+
+	msalErrors "github.com/AzureAD/microsoft-authentication-library-for-go/apps/errors"
+)
+
+// Offline login defaults
+const (
+	defaultOfflineDir         = "/var/lib/azuread/offline"
+	defaultOfflineMaxAge      = 7 * 24 * 60 * 60
+	defaultOfflineMaxFailures = 5
+)
+
+// offlineStore returns the verifier store, or nil when offline logins are disabled
+func offlineStore(config *conf.Config) *offline.Store {
+	if !config.OfflineAuthEnabled {
+		return nil
+	}
+	dir := config.OfflineAuthDir
+	if dir == "" {
+		dir = defaultOfflineDir
+	}
+	maxAge := config.OfflineAuthMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultOfflineMaxAge
+	}
+	maxFailures := config.OfflineAuthMaxFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultOfflineMaxFailures
+	}
+	return offline.New(dir, time.Duration(maxAge)*time.Second, maxFailures)
+}
+
+// unreachable reports whether an authentication error means AzureAD could not
+// be reached, rather than AzureAD rejecting the login
+func unreachable(err error) bool {
+	var callErr msalErrors.CallErr
+	if errors.As(err, &callErr) {
+		return callErr.Resp != nil && callErr.Resp.StatusCode >= http.StatusInternalServerError
+	}
+	if directory.StatusOf(err) == directory.StatusTryAgain {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// AzureAD error code for sign-ins to disabled accounts
+const disabledAccountCode = "AADSTS50057"
+
+// accountDisabled reports whether an authentication error means AzureAD
+// refused the login because the account is disabled
+func accountDisabled(err error) bool {
+	return strings.Contains(err.Error(), disabledAccountCode)
+}
+
+// offlineAuthenticate checks password against the user's offline verifier
+func offlineAuthenticate(store *offline.Store, user string, password string) int {
+	err := store.Verify(user, password)
+	switch err {
+	case nil:
+		pamLog("AzureAD unreachable, offline authentication succeeded for user: %s", user)
+		return PAM_SUCCESS
+	case offline.ErrMismatch:
+		pamLog("AzureAD unreachable, offline authentication failed for user: %s", user)
+		return PAM_AUTH_ERR
+	default:
+		pamLog("AzureAD unreachable, offline authentication unavailable for user: %s. Error: %v", user, err)
+		return PAM_AUTHINFO_UNAVAIL
+	}
+}
@@ -103,3 +103,14 @@ char *request_pass(pam_handle_t *pamh, int echocode,
   }
   return ret;
 }
+
+void send_message(pam_handle_t *pamh, int style, PAM_CONST char *text) {
+  PAM_CONST struct pam_message msg = {.msg_style = style, .msg = text};
+  PAM_CONST struct pam_message *msgs = &msg;
+  struct pam_response *resp = NULL;
+  converse(pamh, 1, &msgs, &resp);
+  if (resp) {
+    free(resp->resp);
+    free(resp);
+  }
+}
@@ -14,14 +14,18 @@ int get_uid(char *user);
 int change_euid(int);
 int disable_ptrace();
 char *request_pass(pam_handle_t *, int, const char *);
+void send_message(pam_handle_t *, int, const char *);
 */
 import "C"
 
 const (
-	PAM_OPEN_ERR     = C.PAM_OPEN_ERR
-	PAM_USER_UNKNOWN = C.PAM_USER_UNKNOWN
-	PAM_AUTH_ERR     = C.PAM_AUTH_ERR
-	PAM_SUCCESS      = C.PAM_SUCCESS
+	PAM_OPEN_ERR         = C.PAM_OPEN_ERR
+	PAM_USER_UNKNOWN     = C.PAM_USER_UNKNOWN
+	PAM_AUTH_ERR         = C.PAM_AUTH_ERR
+	PAM_AUTHINFO_UNAVAIL = C.PAM_AUTHINFO_UNAVAIL
+	PAM_PERM_DENIED      = C.PAM_PERM_DENIED
+	PAM_ACCT_EXPIRED     = C.PAM_ACCT_EXPIRED
+	PAM_SUCCESS          = C.PAM_SUCCESS
 )
 
 func init() {
@@ -62,6 +66,18 @@ func pam_sm_setcred(pamh *C.pam_handle_t, flags, argc C.int, argv **C.char) C.in
 	return C.PAM_SUCCESS
 }
 
+//export pam_sm_acct_mgmt
+func pam_sm_acct_mgmt(pamh *C.pam_handle_t, flags, argc C.int, argv **C.char) C.int {
+	cUsername := C.get_user(pamh)
+	if cUsername == nil {
+		return C.PAM_USER_UNKNOWN
+	}
+	defer C.free(unsafe.Pointer(cUsername))
+
+	r := pamAcctMgmt(pamh, int(flags), C.GoString(cUsername))
+	return C.int(r)
+}
+
 func seteuid(uid int) bool {
 	return C.change_euid(C.int(uid)) == C.int(0)
 }
@@ -79,6 +95,16 @@ func requestPass(pamh *C.pam_handle_t, echocode int, prompt string) string {
 	return ret
 }
 
+// sendError shows text to the user, unless the application asked for silence
+func sendError(pamh *C.pam_handle_t, flags int, text string) {
+	if flags&C.PAM_SILENT != 0 {
+		return
+	}
+	ctext := C.CString(text)
+	defer C.free(unsafe.Pointer(ctext))
+	C.send_message(pamh, C.PAM_ERROR_MSG, ctext)
+}
+
 func getUser(pamh *C.pam_handle_t) string {
 	cUsername := C.get_user(pamh)
 	defer C.free(unsafe.Pointer(cUsername))
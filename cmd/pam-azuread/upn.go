@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/directory"
+)
+
+// loginUPN returns the UPN a login name signs in as, using the same username
+// mapping as NSS. Mappings that cannot be reversed locally are looked up in
+// AzureAD with the read only application. Local accounts are not in AzureAD
+// and are reported not found.
+func loginUPN(config *conf.Config, username string) (string, error) {
+	if directory.LocalUser(username) {
+		return "", directory.ErrLocalUser
+	}
+	if upn, ok := directory.UPN(config, username); ok {
+		return upn, nil
+	}
+	token, err := directory.Token(config, "")
+	if err != nil {
+		return "", err
+	}
+	return directory.New(config, token, false).UserPrincipalName(username)
+}
@@ -0,0 +1,334 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/conf"
+)
+
+// Databases held in the cache, one file each
+const (
+	Passwd = "passwd"
+	Group  = "group"
+	Shadow = "shadow"
+)
+
+// Fetcher looks up a value from the directory when the cache cannot answer
+type Fetcher func() (interface{}, error)
+
+// Cache is an on-disk store of NSS entries shared by every process on the host.
+// Entries are written by root and read by everyone, except shadow which is root only.
+type Cache struct {
+	Dir string
+	//Entries younger than TTL are served without asking the directory
+	TTL time.Duration
+	//Entries within StaleTTL after expiring are refreshed, and served when the
+	//refresh takes longer than RefreshTimeout or fails
+	StaleTTL       time.Duration
+	RefreshTimeout time.Duration
+	//Entries within OfflineTTL after expiring are served when the directory cannot be reached
+	OfflineTTL time.Duration
+	//Errors for which the directory is known to have answered, these never fall back to stale entries
+	IsNotFound func(error) bool
+
+	mu         sync.Mutex
+	tables     map[string]*table
+	refreshing map[string]bool
+}
+
+// entry is a single cached value
+type entry struct {
+	Value   json.RawMessage `json:"value"`
+	Fetched time.Time       `json:"fetched"`
+}
+
+// table is the in-memory copy of one database file
+type table struct {
+	Entries map[string]entry `json:"entries"`
+	modTime time.Time
+	size    int64
+}
+
+// Defaults for the cache- settings, in seconds
+const (
+	defaultDir        = "/var/cache/azuread"
+	defaultTTL        = 300
+	defaultStaleTTL   = 300
+	defaultOfflineTTL = 7 * 24 * 3600
+)
+
+// How long a lookup waits for a stale entry to be refreshed. Lookups run in
+// the process asking, which often exits as soon as it has its answer, so the
+// refresh is waited for rather than left to finish on its own.
+const defaultRefreshTimeout = 2 * time.Second
+
+// ForConfig returns the cache set up in config, or nil when caching is disabled
+func ForConfig(config *conf.Config) *Cache {
+	if !config.CacheEnabled {
+		return nil
+	}
+	dir := config.CacheDir
+	if dir == "" {
+		dir = defaultDir
+	}
+	return New(dir,
+		seconds(config.CacheTTL, defaultTTL),
+		seconds(config.CacheStaleTTL, defaultStaleTTL),
+		seconds(config.CacheOfflineTTL, defaultOfflineTTL))
+}
+
+// seconds converts a config value to a duration, using def when unset
+func seconds(v int, def int) time.Duration {
+	if v <= 0 {
+		v = def
+	}
+	return time.Duration(v) * time.Second
+}
+
+// New returns a cache stored in dir
+func New(dir string, ttl, staleTTL, offlineTTL time.Duration) *Cache {
+	return &Cache{
+		Dir:            dir,
+		TTL:            ttl,
+		StaleTTL:       staleTTL,
+		OfflineTTL:     offlineTTL,
+		RefreshTimeout: defaultRefreshTimeout,
+		tables:         map[string]*table{},
+		refreshing:     map[string]bool{},
+	}
+}
+
+// Lookup decodes the cached value for key into out, calling fetch when the entry
+// is missing or expired. Stale entries are served when refreshing them fails or
+// takes longer than RefreshTimeout, and in place of a failed fetch while within
+// the offline window.
+func (c *Cache) Lookup(db string, key string, out interface{}, fetch Fetcher) error {
+	e, ok := c.get(db, key)
+	if ok {
+		age := time.Since(e.Fetched)
+		if age < c.TTL {
+			return json.Unmarshal(e.Value, out)
+		}
+		if age < c.TTL+c.StaleTTL {
+			raw, ok, err := c.refresh(db, key, fetch)
+			if !ok {
+				return json.Unmarshal(e.Value, out)
+			}
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(raw, out)
+		}
+	}
+
+	value, err := fetch()
+	if err != nil {
+		if ok && (c.IsNotFound == nil || !c.IsNotFound(err)) && time.Since(e.Fetched) < c.TTL+c.OfflineTTL {
+			//Directory unreachable, serve what we have
+			return json.Unmarshal(e.Value, out)
+		}
+		if ok && c.IsNotFound != nil && c.IsNotFound(err) {
+			c.Delete(db, key)
+		}
+		return err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	c.Put(db, map[string]interface{}{key: json.RawMessage(raw)})
+	return json.Unmarshal(raw, out)
+}
+
+// Put stores values by key in db, replacing any existing entries
+func (c *Cache) Put(db string, values map[string]interface{}) error {
+	now := time.Now()
+	return c.update(db, func(t *table) error {
+		for key, value := range values {
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			t.Entries[key] = entry{Value: raw, Fetched: now}
+		}
+		return nil
+	})
+}
+
+// Delete removes keys from db
+func (c *Cache) Delete(db string, keys ...string) error {
+	return c.update(db, func(t *table) error {
+		for _, key := range keys {
+			delete(t.Entries, key)
+		}
+		return nil
+	})
+}
+
+// refresh fetches key, waiting at most RefreshTimeout, and stores the result.
+// ok is false when the stale entry should be served instead: the directory
+// could not be reached, did not answer in time, or key is already being
+// refreshed. A definite "not found" is returned as err.
+func (c *Cache) refresh(db string, key string, fetch Fetcher) (raw json.RawMessage, ok bool, err error) {
+	c.mu.Lock()
+	if c.refreshing[db+"/"+key] {
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	c.refreshing[db+"/"+key] = true
+	c.mu.Unlock()
+
+	type result struct {
+		raw json.RawMessage
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, db+"/"+key)
+			c.mu.Unlock()
+		}()
+		value, err := fetch()
+		if err != nil {
+			if c.IsNotFound != nil && c.IsNotFound(err) {
+				c.Delete(db, key)
+			}
+			done <- result{err: err}
+			return
+		}
+		raw, err := json.Marshal(value)
+		if err == nil {
+			c.Put(db, map[string]interface{}{key: json.RawMessage(raw)})
+		}
+		done <- result{raw, err}
+	}()
+
+	timer := time.NewTimer(c.RefreshTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.err != nil && (c.IsNotFound == nil || !c.IsNotFound(r.err)) {
+			return nil, false, nil
+		}
+		return r.raw, true, r.err
+	case <-timer.C:
+		//Left to finish if this process lives long enough
+		return nil, false, nil
+	}
+}
+
+// get returns the entry for key, reloading the database file if it changed on disk
+func (c *Cache) get(db string, key string) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, err := c.load(db)
+	if err != nil {
+		return entry{}, false
+	}
+	e, ok := t.Entries[key]
+	return e, ok
+}
+
+// load returns the in-memory table for db, rereading it when the file has changed
+func (c *Cache) load(db string) (*table, error) {
+	path := c.path(db)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return &table{Entries: map[string]entry{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := c.tables[db]; ok && t.modTime.Equal(info.ModTime()) && t.size == info.Size() {
+		return t, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("corrupt cache file %s: %w", path, err)
+	}
+	if t.Entries == nil {
+		t.Entries = map[string]entry{}
+	}
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	c.tables[db] = t
+	return t, nil
+}
+
+// update applies fn to db under an exclusive lock and writes the result atomically
+func (c *Cache) update(db string, fn func(*table) error) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(c.path(db)+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, err := c.load(db)
+	if err != nil {
+		//Start again rather than keep a corrupt file
+		t = &table{Entries: map[string]entry{}}
+	}
+	if err := fn(t); err != nil {
+		return err
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.Dir, "."+db+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), c.mode(db)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path(db)); err != nil {
+		return err
+	}
+	//Force a reload on next read
+	delete(c.tables, db)
+	return nil
+}
+
+// path returns the file holding db
+func (c *Cache) path(db string) string {
+	return filepath.Join(c.Dir, db+".json")
+}
+
+// mode returns the file permissions for db, shadow entries are readable by root only
+func (c *Cache) mode(db string) os.FileMode {
+	if db == Shadow {
+		return 0600
+	}
+	return 0644
+}
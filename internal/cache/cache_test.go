@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	errNotFound    = errors.New("not found")
+	errUnreachable = errors.New("unreachable")
+)
+
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+	c := New(t.TempDir(), time.Minute, time.Minute, time.Hour)
+	c.RefreshTimeout = 50 * time.Millisecond
+	c.IsNotFound = func(err error) bool { return errors.Is(err, errNotFound) }
+	//Refreshes left running write to the directory, wait for them first
+	t.Cleanup(func() {
+		for {
+			c.mu.Lock()
+			running := len(c.refreshing)
+			c.mu.Unlock()
+			if running == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return c
+}
+
+// putAged stores value under key as if it had been fetched age ago
+func putAged(t *testing.T, c *Cache, key string, value string, age time.Duration) {
+	t.Helper()
+	err := c.update(Passwd, func(tb *table) error {
+		raw, _ := json.Marshal(value)
+		tb.Entries[key] = entry{Value: raw, Fetched: time.Now().Add(-age)}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fetcher returns a Fetcher answering value or err after delay, counting its calls
+func fetcher(calls *int32, value string, err error, delay time.Duration) Fetcher {
+	return func() (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		time.Sleep(delay)
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		//Age of the cached entry, none when negative
+		age   time.Duration
+		err   error
+		delay time.Duration
+		want  string
+		//Error wanted from Lookup
+		wantErr error
+		//Whether fetch is called
+		fetched bool
+		//Value cached afterwards, none when empty
+		cached string
+	}{
+		{"missing", -1, nil, 0, "new", nil, true, "new"},
+		{"fresh", 30 * time.Second, nil, 0, "old", nil, false, "old"},
+		{"stale, refreshed", 90 * time.Second, nil, 0, "new", nil, true, "new"},
+		{"stale, refresh too slow", 90 * time.Second, nil, 200 * time.Millisecond, "old", nil, true, "old"},
+		{"stale, unreachable", 90 * time.Second, errUnreachable, 0, "old", nil, true, "old"},
+		{"stale, deleted", 90 * time.Second, errNotFound, 0, "", errNotFound, true, ""},
+		{"expired, refreshed", 10 * time.Minute, nil, 0, "new", nil, true, "new"},
+		{"expired, unreachable", 10 * time.Minute, errUnreachable, 0, "old", nil, true, "old"},
+		{"expired, deleted", 10 * time.Minute, errNotFound, 0, "", errNotFound, true, ""},
+		{"offline window over", 2 * time.Hour, errUnreachable, 0, "", errUnreachable, true, "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			if tt.age >= 0 {
+				putAged(t, c, "key", "old", tt.age)
+			}
+			var calls int32
+			var got string
+			start := time.Now()
+			err := c.Lookup(Passwd, "key", &got, fetcher(&calls, "new", tt.err, tt.delay))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if fetched := atomic.LoadInt32(&calls) != 0; fetched != tt.fetched {
+				t.Errorf("fetched %v, want %v", fetched, tt.fetched)
+			}
+			if elapsed := time.Since(start); elapsed > c.RefreshTimeout+100*time.Millisecond {
+				t.Errorf("took %v, want at most the refresh timeout", elapsed)
+			}
+
+			e, ok := c.get(Passwd, "key")
+			cached := ""
+			if ok {
+				json.Unmarshal(e.Value, &cached)
+			}
+			if cached != tt.cached {
+				t.Errorf("cached %q, want %q", cached, tt.cached)
+			}
+		})
+	}
+}
+
+// A refresh that misses the deadline is still stored when it finishes
+func TestLookupSlowRefreshStored(t *testing.T) {
+	c := newTestCache(t)
+	putAged(t, c, "key", "old", 90*time.Second)
+	var calls int32
+	var got string
+	if err := c.Lookup(Passwd, "key", &got, fetcher(&calls, "new", nil, 2*c.RefreshTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if got != "old" {
+		t.Errorf("got %q, want the stale %q", got, "old")
+	}
+
+	//A second lookup while the refresh runs does not start another
+	if err := c.Lookup(Passwd, "key", &got, fetcher(&calls, "other", nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("fetched %d times, want 1", calls)
+	}
+
+	time.Sleep(3 * c.RefreshTimeout)
+	if err := c.Lookup(Passwd, "key", &got, fetcher(&calls, "other", nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got != "new" {
+		t.Errorf("got %q after the refresh finished, want %q", got, "new")
+	}
+}
@@ -3,6 +3,7 @@ package conf
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,6 +11,10 @@ import (
 const configFile = "/etc/azuread.conf"
 const configFileSecrets = "/etc/azuread-secret.conf"
 
+// Default endpoints for the Azure public cloud
+const defaultAuthorityHost = "https://login.microsoftonline.com/"
+const defaultGraphURL = "https://graph.microsoft.com:443/"
+
 // config define azureAD parameters
 // and setting for this module
 type Config struct {
@@ -18,7 +23,36 @@ type Config struct {
 	RedirectURL  string `yaml:"redirect-url"`
 	TenantID     string `yaml:"tenant-id"`
 	Domain       string `yaml:"o365-domain"`
-	//Used for lookup of user UID from AzureAD Custom Security Attributes
+	//Endpoints, override for sovereign clouds or a local identity provider
+	AuthorityHost string `yaml:"authority-host"`
+	GraphURL      string `yaml:"graph-url"`
+	//Where user UID/GID attributes are read from: "extension" (default), "security-attributes" or "on-premises"
+	UserAttributeSource string `yaml:"user-attribute-source"`
+	//How usernames are built: "short" (default), "strip-primary-domain", "upn", "mailNickname", "onPremisesSamAccountName" or "user.domain"
+	UsernameMapping   string   `yaml:"username-mapping"`
+	UsernameLowercase bool     `yaml:"username-lowercase"`
+	UsernameDomains   []string `yaml:"username-domains"`
+	UsernameGuests    bool     `yaml:"username-include-guests"`
+	//Older way of setting username-mapping: onPremisesSamAccountName
+	UsernameAttribute string `yaml:"username-attribute"`
+	//Which users and groups are visible: raw OData filters, and members of groups or administrative units
+	UserFilter            string   `yaml:"user-filter"`
+	UserIncludeUnlicensed bool     `yaml:"user-include-unlicensed"`
+	UserScopeGroups       []string `yaml:"user-scope-groups"`
+	UserScopeUnits        []string `yaml:"user-scope-administrative-units"`
+	UserHideDisabled      bool     `yaml:"user-hide-disabled"`
+	GroupFilter           string   `yaml:"group-filter"`
+	GroupScopeGroups      []string `yaml:"group-scope-groups"`
+	GroupScopeUnits       []string `yaml:"group-scope-administrative-units"`
+	//List members of nested groups as members, resolved through transitiveMembers
+	GroupNestedMembers bool `yaml:"group-nested-members"`
+	//Where group names are read from: "displayName" (default), "mailNickname", "onPremisesSamAccountName" or a directory extension
+	GroupNameAttribute string `yaml:"group-name-attribute"`
+	//Use group names as stored in AzureAD instead of sanitizing them into POSIX names
+	GroupNameRaw bool `yaml:"group-name-raw"`
+	//Azure AD group object ID -> local group in /etc/group its members are merged into
+	GroupMappings map[string]string `yaml:"group-mappings"`
+	//Used for lookup of user UID from AzureAD Custom Security Attributes, same as user-attribute-source: security-attributes
 	UseSecAttributes  bool   `yaml:"custom-security-attributes"`
 	AttributeSet      string `yaml:"attribute-set"`
 	UserUIDAttribute  string `yaml:"user-uid-attribute-name"`
@@ -31,6 +65,51 @@ type Config struct {
 	GroupAutoGID      bool   `yaml:"group-auto-gid"`
 	MinGID            int    `yaml:"gid-range-min"`
 	MaxGID            int    `yaml:"gid-range-max"`
+	//IDs never allocated, as "min-max" or a single ID. IDs in /etc/passwd and /etc/group are always skipped
+	ReservedUIDRanges []string `yaml:"reserved-uid-ranges"`
+	ReservedGIDRanges []string `yaml:"reserved-gid-ranges"`
+	//Home directory template and login shell, optionally overridden per user from attributes
+	HomeDir            string `yaml:"home-dir"`
+	DefaultShell       string `yaml:"default-shell"`
+	FallbackShell      string `yaml:"fallback-shell"`
+	UserHomeAttribute  string `yaml:"user-home-attribute-name"`
+	UserShellAttribute string `yaml:"user-shell-attribute-name"`
+	//Give each user a group of their own, with GID equal to UID, as their primary group
+	UserPrivateGroups bool `yaml:"user-private-groups"`
+	//How user-auto-uid/group-auto-gid pick an unused ID, and how full a range gets before warning
+	IDAllocation       string `yaml:"id-allocation"`
+	IDRangeWarnPercent int    `yaml:"id-range-warn-percent"`
+	//How missing UIDs/GIDs are assigned, "attribute" (default) writes them to Azure AD, "hash" derives them from object IDs
+	IDMapping          string `yaml:"id-mapping"`
+	IDMappingMin       int    `yaml:"id-mapping-range-min"`
+	IDMappingMax       int    `yaml:"id-mapping-range-max"`
+	IDMappingSliceSize int    `yaml:"id-mapping-slice-size"`
+	//Microsoft Graph paging, $top page size and maximum number of @odata.nextLink pages followed
+	GraphPageSize int `yaml:"graph-page-size"`
+	GraphMaxPages int `yaml:"graph-max-pages"`
+	//Retries of throttled (429) and unavailable (503/504) Graph requests, and total seconds allowed per request
+	GraphMaxRetries  int `yaml:"graph-max-retries"`
+	GraphRetryBudget int `yaml:"graph-retry-budget"`
+	//Local directory cache, TTLs in seconds
+	CacheEnabled    bool   `yaml:"cache-enabled"`
+	CacheDir        string `yaml:"cache-dir"`
+	CacheTTL        int    `yaml:"cache-ttl"`
+	CacheStaleTTL   int    `yaml:"cache-stale-ttl"`
+	CacheOfflineTTL int    `yaml:"cache-offline-ttl"`
+	//Answer NSS lookups through azuread-syncd, sync interval in seconds
+	SyncdEnabled   bool   `yaml:"syncd-enabled"`
+	SyncdSocket    string `yaml:"syncd-socket"`
+	SyncdInterval  int    `yaml:"syncd-interval"`
+	SyncdStateFile string `yaml:"syncd-state-file"`
+	//Offline PAM logins from a local password verifier, max age in seconds
+	OfflineAuthEnabled     bool   `yaml:"offline-auth-enabled"`
+	OfflineAuthDir         string `yaml:"offline-auth-dir"`
+	OfflineAuthMaxAge      int    `yaml:"offline-auth-max-age"`
+	OfflineAuthMaxFailures int    `yaml:"offline-auth-max-failures"`
+	//Who may log in to this host: object IDs of allowed and denied groups, and app roles of the client-id enterprise application
+	AccessAllowGroups []string `yaml:"access-allow-groups"`
+	AccessDenyGroups  []string `yaml:"access-deny-groups"`
+	AccessAppRoles    []string `yaml:"access-app-roles"`
 	//Should not need to change these...
 	PamScopes []string `yaml:"pam-scopes"`
 	NssScopes []string `yaml:"nss-scopes"`
@@ -40,6 +119,23 @@ type ConfigSecrets struct {
 	ClientSecret string `yaml:"client-secret"`
 }
 
+// Authority returns the tenant authority URL used for token requests
+func (c *Config) Authority() string {
+	host := c.AuthorityHost
+	if host == "" {
+		host = defaultAuthorityHost
+	}
+	return strings.TrimSuffix(host, "/") + "/" + c.TenantID
+}
+
+// GraphBaseURL returns the Microsoft Graph endpoint requests are made against
+func (c *Config) GraphBaseURL() string {
+	if c.GraphURL == "" {
+		return defaultGraphURL
+	}
+	return c.GraphURL
+}
+
 // ReadConfig
 // need file path from yaml and return config
 func ReadConfig() (*Config, error) {
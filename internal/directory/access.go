@@ -0,0 +1,141 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// Host access control for PAM account management. Users disabled in Azure AD
+// are always refused, as is a user in any of access-deny-groups. Otherwise,
+// when access-allow-groups or access-app-roles is set, the user must be in
+// one of the allowed groups, nested groups included, or be assigned one of
+// the app roles of the enterprise application for client-id.
+
+// AnyAppRole in access-app-roles accepts any assignment to the enterprise
+// application, the default access role included
+const AnyAppRole = "*"
+
+// ErrAccountDisabled is returned by Access for users disabled in Azure AD
+var ErrAccountDisabled = errors.New("account disabled in Azure AD")
+
+// ErrLocalUser is returned by CheckAccess for accounts in /etc/passwd. It is a
+// not found error, PAM passes such users on to the modules that know them.
+var ErrLocalUser = fmt.Errorf("local account, %w", ErrNotFound)
+
+// AccessRestricted reports whether logins to this host are limited by group or app role
+func AccessRestricted(config *conf.Config) bool {
+	return len(config.AccessAllowGroups) != 0 || len(config.AccessDenyGroups) != 0 || len(config.AccessAppRoles) != 0
+}
+
+// CheckAccess reports whether the user with login name name may log in to
+// this host, using the read only application. Local accounts are refused with
+// ErrLocalUser before Azure AD is contacted, so root and other local users are
+// not locked out while it is unreachable.
+func CheckAccess(config *conf.Config, name string) (allowed bool, reason string, err error) {
+	if LocalUser(name) {
+		return false, "", ErrLocalUser
+	}
+	token, err := Token(config, "")
+	if err != nil {
+		return false, "", err
+	}
+	return New(config, token, false).Access(name)
+}
+
+// Access reports whether the user with login name name may log in to this
+// host. When they may not, reason says why. Disabled users are refused with
+// ErrAccountDisabled.
+func (d *Directory) Access(name string) (allowed bool, reason string, err error) {
+	debugLog.Println("Access Query:", name) //DEBUG
+	var user graph.User
+	if err := d.getUserByName(name, "id,userPrincipalName,onPremisesSamAccountName,mailNickname,accountEnabled", &user); err != nil {
+		errorLog.Println("Access MSGraph request failed:", err)
+		return false, "", err
+	}
+	if !enabled(user.AccountEnabled) {
+		return false, "account disabled", ErrAccountDisabled
+	}
+	if !AccessRestricted(d.config) {
+		return true, "", nil
+	}
+
+	groups, err := d.queryIDs("v1.0/users/" + url.PathEscape(user.ID) + "/transitiveMemberOf/microsoft.graph.group?$select=id")
+	if err != nil {
+		return false, "", err
+	}
+	for _, id := range d.config.AccessDenyGroups {
+		if groups[id] {
+			return false, "member of denied group " + id, nil
+		}
+	}
+	if len(d.config.AccessAllowGroups) == 0 && len(d.config.AccessAppRoles) == 0 {
+		return true, "", nil
+	}
+	for _, id := range d.config.AccessAllowGroups {
+		if groups[id] {
+			return true, "", nil
+		}
+	}
+	if len(d.config.AccessAppRoles) != 0 {
+		assigned, err := d.hasAppRole(user.ID)
+		if err != nil {
+			return false, "", err
+		}
+		if assigned {
+			return true, "", nil
+		}
+	}
+	return false, "not a member of an allowed group or assigned an allowed app role", nil
+}
+
+// hasAppRole reports whether a user is assigned one of access-app-roles on
+// the enterprise application, directly or through a group. App roles are
+// not inherited through nested groups, so only groups the user is a direct
+// member of count, which are the groups Graph includes in the user's
+// appRoleAssignments.
+func (d *Directory) hasAppRole(userID string) (bool, error) {
+	var sp graph.ServicePrincipal
+	getSPQuery := "v1.0/servicePrincipals(appId=" + odataString(d.config.ClientID) + ")?$select=id,appId,appRoles"
+	debugLog.Println("Service Principal Query:", d.config.ClientID) //DEBUG
+	if err := d.client.Get(getSPQuery, &sp); err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return false, err
+	}
+
+	wanted := map[string]bool{}
+	anyRole := false
+	for _, value := range d.config.AccessAppRoles {
+		if value == AnyAppRole {
+			anyRole = true
+		}
+		for _, role := range sp.AppRoles {
+			if role.Value == value {
+				wanted[role.ID] = true
+			}
+		}
+	}
+	if !anyRole && len(wanted) == 0 {
+		warnLog.Println("None of access-app-roles are roles of application", d.config.ClientID)
+		return false, nil
+	}
+
+	//Only the assignments to this application, resourceId is a GUID so is not quoted
+	getAssignmentsQuery := "v1.0/users/" + url.PathEscape(userID) + "/appRoleAssignments?$select=appRoleId,resourceId&$filter=resourceId+eq+" + url.QueryEscape(sp.ID)
+	debugLog.Println("App Role Assignments Query:", userID) //DEBUG
+	assignments, err := d.client.GetAppRoleAssignments(getAssignmentsQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return false, err
+	}
+	for _, a := range assignments {
+		if strings.EqualFold(a.ResourceID, sp.ID) && (anyRole || wanted[a.AppRoleID]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,42 @@
+package directory
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/datty/pam-azuread/internal/conf"
+)
+
+// With Azure AD down, local accounts are reported not found so PAM passes
+// them on, and Azure AD users fail without being reported not found
+func TestCheckAccessGraphDown(t *testing.T) {
+	passwd := filepath.Join(t.TempDir(), "passwd")
+	if err := ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	passwdFile := localPasswdFile
+	localPasswdFile = passwd
+	t.Cleanup(func() { localPasswdFile = passwdFile })
+
+	//Neither the authority nor Graph answers
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	config := &conf.Config{
+		TenantID:      "00000000-0000-0000-0000-000000000001",
+		ClientID:      "00000000-0000-0000-0000-000000000002",
+		ClientSecret:  "secret",
+		AuthorityHost: down.URL + "/",
+		GraphURL:      down.URL,
+	}
+
+	if _, _, err := CheckAccess(config, "root"); !errors.Is(err, ErrLocalUser) || !IsNotFound(err) {
+		t.Errorf("local user got error %v, want ErrLocalUser", err)
+	}
+	if _, _, err := CheckAccess(config, "alice@example.com"); err == nil || IsNotFound(err) {
+		t.Errorf("Azure AD user got error %v, want unavailable", err)
+	}
+}
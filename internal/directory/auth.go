@@ -0,0 +1,47 @@
+package directory
+
+import (
+	"context"
+
+	"github.com/datty/pam-azuread/internal/conf"
+
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+)
+
+// Token acquires a Microsoft Graph access token using the client credentials in config.
+// When cacheFile is set the MSAL token cache is persisted there and tokens are reused silently.
+func Token(config *conf.Config, cacheFile string) (string, error) {
+
+	//Open OAuth
+	cred, err := confidential.NewCredFromSecret(config.ClientSecret)
+	if err != nil {
+		errorLog.Println(err)
+		return "", err
+	}
+
+	options := []confidential.Option{confidential.WithAuthority(config.Authority())}
+	if cacheFile != "" {
+		//Enable oauth cred cache
+		options = append(options, confidential.WithAccessor(&TokenCache{cacheFile}))
+	}
+	app, err := confidential.New(config.ClientID, cred, options...)
+	if err != nil {
+		errorLog.Println(err)
+		return "", err
+	}
+
+	if cacheFile != "" {
+		result, err := app.AcquireTokenSilent(context.Background(), config.NssScopes)
+		if err == nil {
+			debugLog.Println("Silently acquired token")
+			return result.AccessToken, nil
+		}
+	}
+	result, err := app.AcquireTokenByCredential(context.Background(), config.NssScopes)
+	if err != nil {
+		errorLog.Println(err)
+		return "", err
+	}
+	debugLog.Println("Acquired Access Token")
+	return result.AccessToken, nil
+}
@@ -0,0 +1,796 @@
+package directory
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/graph"
+	"github.com/datty/pam-azuread/internal/logger"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+var debugLog = logger.Debug
+var warnLog = logger.Warn
+var errorLog = logger.Error
+
+// Directory answers passwd, group and shadow lookups from Azure AD
+type Directory struct {
+	config *conf.Config
+	client *graph.Client
+	//Allows missing UIDs/GIDs to be allocated and written back to Azure AD
+	writable bool
+
+	//Login shells allowed by /etc/shells, read on first use
+	shellsOnce sync.Once
+	shells     map[string]bool
+	//GIDs of the groups in /etc/group, read on first use
+	localGroupsOnce sync.Once
+	localGroups     map[string]uint
+}
+
+// New returns a Directory querying Microsoft Graph with token. writable must only
+// be set when token was issued to the privileged (read/write) application.
+func New(config *conf.Config, token string, writable bool) *Directory {
+	return &Directory{
+		config:   config,
+		client:   graphClient(config, token),
+		writable: writable,
+	}
+}
+
+// Build a Microsoft Graph client for the given token
+func graphClient(config *conf.Config, t string) *graph.Client {
+	gc := graph.NewClient(t)
+	gc.BaseURL = config.GraphBaseURL()
+	gc.PageSize = config.GraphPageSize
+	if config.GraphMaxPages > 0 {
+		gc.MaxPages = config.GraphMaxPages
+	}
+	retry := graph.NewRetryTransport()
+	if config.GraphMaxRetries > 0 {
+		retry.MaxRetries = config.GraphMaxRetries
+	}
+	if config.GraphRetryBudget > 0 {
+		retry.Budget = time.Duration(config.GraphRetryBudget) * time.Second
+	}
+	gc.HTTPClient = &http.Client{Transport: retry}
+	return gc
+}
+
+// Where POSIX IDs are stored on users and groups
+func (d *Directory) idAttributes() graph.IDAttributes {
+	source := d.config.UserAttributeSource
+	if source == "" && d.config.UseSecAttributes {
+		source = graph.SourceSecurityAttributes
+	}
+	return graph.IDAttributes{
+		Source:       source,
+		AttributeSet: d.config.AttributeSet,
+		UserUIDName:  d.config.UserUIDAttribute,
+		UserGIDName:  d.config.UserGIDAttribute,
+		GroupGIDName: d.config.GroupGidAttribute,
+		//Per-user home directory and shell
+		UserHomeName:  d.config.UserHomeAttribute,
+		UserShellName: d.config.UserShellAttribute,
+	}
+}
+
+// $select fields needed to build passwd entries
+func (d *Directory) userSelect() string {
+	return "id,displayName,userPrincipalName,onPremisesSamAccountName,mailNickname,assignedLicenses,accountEnabled," + d.idAttributes().UserSelect()
+}
+
+// $select fields needed for the names of group members
+const memberSelect = "id,userPrincipalName,onPremisesSamAccountName,mailNickname,accountEnabled"
+
+// $expand clause returning group members with the fields needed for their names
+const membersExpand = "$expand=members($select=" + memberSelect + ")"
+
+// Graph expands at most this many members, groups with more are paged separately
+const membersExpandLimit = 20
+
+// $select fields needed to build shadow entries
+const shadowSelect = "id,userPrincipalName,onPremisesSamAccountName,mailNickname,assignedLicenses,accountEnabled,lastPasswordChangeDateTime"
+
+// Quote a string for use in an OData $filter
+func odataString(s string) string {
+	return "'" + url.QueryEscape(strings.ReplaceAll(s, "'", "''")) + "'"
+}
+
+// Convert a graph user to a passwd entry, hasUID is false when no UID is set
+func (d *Directory) userToPasswd(u graph.User) (passwd nssStructs.Passwd, hasUID bool, err error) {
+	attrs := d.idAttributes()
+
+	//Set default GID
+	passwd.GID = d.config.UserDefaultGID
+
+	//Get UID/GID
+	passwd.UID, hasUID, err = attrs.UserUID(u)
+	if err != nil {
+		return passwd, false, err
+	}
+	if !hasUID && d.hashMapping() {
+		passwd.UID, hasUID = d.hashID(u.ID), true
+	}
+	gid, hasGID, err := attrs.UserGID(u)
+	if err != nil {
+		return passwd, false, err
+	}
+	if hasGID {
+		passwd.GID = gid
+	}
+
+	user, ok := d.username(u)
+	if !ok {
+		return passwd, false, errNoUsername
+	}
+
+	//Set user info
+	passwd.Username = user
+	passwd.Password = "x"
+	passwd.Gecos = u.DisplayName
+	passwd.Dir = d.homeDir(u, user)
+	passwd.Shell = d.shell(u)
+	return passwd, hasUID, nil
+}
+
+// resolveMembers fetches the members of g that $expand leaves out: every
+// member of groups larger than membersExpandLimit, and members of nested
+// groups when group-nested-members is set
+func (d *Directory) resolveMembers(g *graph.Group) error {
+	relation := "members"
+	if d.config.GroupNestedMembers {
+		relation = "transitiveMembers"
+	} else if len(g.Members) < membersExpandLimit {
+		return nil
+	}
+	getMembersQuery := "v1.0/groups/" + g.ID + "/" + relation + "/microsoft.graph.user?$select=" + memberSelect
+	debugLog.Println("Group Members Query:", g.ID) //DEBUG
+	members, err := d.client.GetMembers(getMembersQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return err
+	}
+	g.Members = members
+	return nil
+}
+
+// resolveAllMembers calls resolveMembers for each group
+func (d *Directory) resolveAllMembers(groups []graph.Group) error {
+	for i := range groups {
+		if err := d.resolveMembers(&groups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collect usernames of the user members of a group
+func (d *Directory) memberNames(members []graph.Member) []string {
+	names := []string{}
+	for _, member := range members {
+		if !member.IsUser() {
+			continue
+		}
+		if d.config.UserHideDisabled && !enabled(member.AccountEnabled) {
+			continue
+		}
+		if name, ok := mapUsername(d.config, member.UserPrincipalName, member.OnPremisesSamAccountName, member.MailNickname); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Convert a graph group to a group entry, hasGID is false when no GID is set
+func (d *Directory) groupToNss(g graph.Group) (group nssStructs.Group, hasGID bool, err error) {
+	if name, gid, ok := d.mappedGroup(g.ID); ok {
+		group.Groupname = name
+		group.GID = gid
+		group.Members = d.memberNames(g.Members)
+		group.Password = "x"
+		return group, true, nil
+	}
+
+	group.GID, hasGID, err = d.idAttributes().GroupGID(g)
+	if err != nil {
+		return group, false, err
+	}
+	if !hasGID && d.hashMapping() {
+		group.GID, hasGID = d.hashID(g.ID), true
+	}
+	group.Groupname = d.groupName(g)
+	if group.Groupname == "" {
+		return group, false, errNoGroupName
+	}
+	group.Members = d.memberNames(g.Members)
+	group.Password = "x"
+	return group, hasGID, nil
+}
+
+// Convert a graph user to a shadow entry, ok is false when the user has no
+// username. Users disabled in Azure AD are locked and expired.
+func (d *Directory) userToShadow(u graph.User) (shadow nssStructs.Shadow, ok bool) {
+	name, ok := d.username(u)
+	if !ok {
+		return shadow, false
+	}
+	shadow = nssStructs.Shadow{
+		Username:       name,
+		Password:       "*",
+		PasswordWarn:   7,
+		LastChange:     int(u.LastPasswordChangeDateTime.Unix() / 86400),
+		MinChange:      0,
+		MaxChange:      99999,
+		ExpirationDate: 99999,
+	}
+	if !enabled(u.AccountEnabled) {
+		shadow.Password = "!*"
+		shadow.ExpirationDate = disabledExpirationDate
+	}
+	return shadow, true
+}
+
+// Shadow expiry date of disabled users, 2 January 1970. 0 is avoided as
+// some tools read it as never expiring.
+const disabledExpirationDate = 1
+
+// enabled reads accountEnabled, users it was not read for count as enabled
+func enabled(accountEnabled *bool) bool {
+	return accountEnabled == nil || *accountEnabled
+}
+
+// PasswdAll returns passwd entries for all users. Users without a UID that
+// cannot be given one are returned with the nobody UID.
+func (d *Directory) PasswdAll() ([]nssStructs.Passwd, error) {
+	passwdResult, err := d.visiblePasswd()
+	if err != nil {
+		return nil, err
+	}
+	if d.config.UserPrivateGroups {
+		gids, err := d.realGIDs()
+		if err != nil {
+			return nil, err
+		}
+		d.usePrivateGroups(passwdResult, gids)
+	}
+	return passwdResult, nil
+}
+
+// visiblePasswd returns passwd entries for all visible users, without private groups
+func (d *Directory) visiblePasswd() ([]nssStructs.Passwd, error) {
+	attrs := d.idAttributes()
+
+	//Build all users query. Filters out users not in scope and only returns required fields.
+	getUserQuery := attrs.UserVersion() + "/users?$count=true&$select=" + d.userSelect() + filterParam(d.userFilter())
+	debugLog.Println("PasswdAll Query") //DEBUG
+	users, err := d.client.GetUsers(getUserQuery)
+	if err != nil {
+		errorLog.Println("PasswdAll MSGraph request failed:", err)
+		return nil, err
+	}
+	scope, err := d.userScope()
+	if err != nil {
+		return nil, err
+	}
+	return d.passwdEntries(scopedUsers(users, scope), nil), nil
+}
+
+// passwdEntries converts users to passwd entries. Missing UIDs are allocated
+// where allowed and reported to assigned, otherwise the nobody UID is used.
+func (d *Directory) passwdEntries(users []graph.User, assigned func(graph.User, uint)) []nssStructs.Passwd {
+
+	//Open Slice/Struct for result
+	passwdResult := []nssStructs.Passwd{}
+
+	var ix *idIndex
+	if d.hashMapping() {
+		ix = d.userIDs(users)
+	}
+	for _, user := range users {
+		tempUser, hasUID, err := d.userToPasswd(user)
+		if isNoUsername(err) {
+			debugLog.Println("No username for", user.UserPrincipalName)
+			continue
+		}
+		if err != nil {
+			errorLog.Println("Skipping user", user.UserPrincipalName, err)
+			continue
+		}
+
+		//Add this user to result if no errors flagged
+		if !hasUID && d.config.UserAutoUID && d.writable {
+			//Do the magic and set UID
+			tempUser.UID, err = d.AutoSetUID(user.ID)
+			if err != nil {
+				continue
+			}
+			if assigned != nil {
+				assigned(user, tempUser.UID)
+			}
+			debugLog.Println("UserID:", user.ID)
+			debugLog.Println("User:", user.UserPrincipalName)
+			debugLog.Println("New UID:", tempUser.UID)
+		} else if !hasUID {
+			//Return nobody UID if a UID cannot be set
+			tempUser.UID = NobodyID
+		}
+		if ix != nil && !ix.owns(user.ID, tempUser.UID, d.hashedUID(user)) {
+			errorLog.Printf("UID %d of %s is shared with another user, skipping. Set a UID attribute on one of them to resolve", tempUser.UID, tempUser.Username)
+			continue
+		}
+		passwdResult = append(passwdResult, tempUser)
+	}
+
+	return dropSharedUsernames(passwdResult)
+}
+
+// PasswdByName returns the passwd entry for a single user
+func (d *Directory) PasswdByName(name string) (nssStructs.Passwd, error) {
+
+	//Build user query, only returns required fields
+	debugLog.Println("PasswdByName Query:", name) //DEBUG
+	var user graph.User
+	err := d.getUserByName(name, d.userSelect(), &user)
+	if err != nil {
+		errorLog.Println("PasswdByName MSGraph request failed:", err)
+		return nssStructs.Passwd{}, err
+	}
+	if inScope, err := d.userInScope(user); err != nil || !inScope {
+		return nssStructs.Passwd{}, notInScope(err)
+	}
+
+	passwdResult, hasUID, err := d.userToPasswd(user)
+	if err != nil {
+		errorLog.Println("PasswdByName invalid user", name, err)
+		return nssStructs.Passwd{}, err
+	}
+
+	//Add this user to result if no errors flagged
+	if !hasUID && d.config.UserAutoUID && d.writable {
+		//Do the magic and set UID
+		passwdResult.UID, err = d.AutoSetUID(user.ID)
+		if err != nil {
+			return nssStructs.Passwd{}, err
+		}
+		debugLog.Println("UserID:", user.ID)              //DEBUG
+		debugLog.Println("User:", user.UserPrincipalName) //DEBUG
+		debugLog.Println("New UID:", passwdResult.UID)    //DEBUG
+	} else if !hasUID {
+		return nssStructs.Passwd{}, ErrNotFound
+	}
+	if d.hashedUID(user) {
+		if owns, err := d.ownsUID(user.ID, passwdResult.UID); err != nil || !owns {
+			return nssStructs.Passwd{}, notInScope(err)
+		}
+	}
+
+	if d.config.UserPrivateGroups {
+		if err := d.usePrivateGroupLive(&passwdResult); err != nil {
+			return nssStructs.Passwd{}, err
+		}
+	}
+	return passwdResult, nil
+}
+
+// PasswdByUid returns the passwd entry for the user with uid
+func (d *Directory) PasswdByUid(uid uint) (nssStructs.Passwd, error) {
+	user, err := d.userByUID(uid)
+	if err != nil {
+		return nssStructs.Passwd{}, err
+	}
+	passwdResult, _, err := d.userToPasswd(user)
+	if err != nil {
+		return nssStructs.Passwd{}, err
+	}
+	if inScope, err := d.userInScope(user); err != nil || !inScope {
+		return nssStructs.Passwd{}, notInScope(err)
+	}
+	if d.config.UserPrivateGroups {
+		if err := d.usePrivateGroupLive(&passwdResult); err != nil {
+			return nssStructs.Passwd{}, err
+		}
+	}
+	return passwdResult, nil
+}
+
+// userByUID returns the user holding uid, in an attribute or hashed
+func (d *Directory) userByUID(uid uint) (graph.User, error) {
+	attrs := d.idAttributes()
+
+	if attrs.UserUIDName != "" {
+		getUserQuery := attrs.UserVersion() + "/users/?$count=true&$select=" + d.userSelect() + "&$filter=" + attrs.UserUIDFilter(uid)
+		debugLog.Println("PasswdByUid Query:", uid) //DEBUG
+		users, err := d.client.GetUsers(getUserQuery)
+		if err != nil {
+			errorLog.Println("PasswdByUid MSGraph request failed:", err)
+			return graph.User{}, err
+		}
+		for _, user := range users {
+			passwdResult, hasUID, err := d.userToPasswd(user)
+			if isNoUsername(err) {
+				continue
+			}
+			if err != nil {
+				errorLog.Println("PasswdByUid invalid user", user.UserPrincipalName, err)
+				continue
+			}
+			if hasUID && passwdResult.UID == uid {
+				return user, nil
+			}
+		}
+	}
+	if !d.hashMapping() {
+		return graph.User{}, ErrNotFound
+	}
+
+	//Hashed UIDs are not stored in Azure AD so cannot be filtered on, the
+	//index maps them back to the user
+	ix, err := d.visibleUserIDs()
+	if err != nil {
+		return graph.User{}, err
+	}
+	id, ok := ix.hashedOwner(uid)
+	if !ok {
+		return graph.User{}, ErrNotFound
+	}
+	var user graph.User
+	if err := d.client.Get(attrs.UserVersion()+"/users/"+url.PathEscape(id)+"?$select="+d.userSelect(), &user); err != nil {
+		errorLog.Println("PasswdByUid MSGraph request failed:", err)
+		return graph.User{}, err
+	}
+	//The user may have been given a UID attribute since the index was read
+	if passwdResult, _, err := d.userToPasswd(user); err != nil || !d.hashedUID(user) || passwdResult.UID != uid {
+		return graph.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+// GroupAll returns all security groups that have, or can be given, a GID
+func (d *Directory) GroupAll() ([]nssStructs.Group, error) {
+
+	//Build all groups query. Filters out groups not in scope
+	getGroupQuery := "v1.0/groups?$count=true&" + membersExpand + "&$select=" + d.groupSelect() + filterParam(d.groupFilter())
+	debugLog.Println("GroupAll Query") //DEBUG
+	groups, err := d.client.GetGroups(getGroupQuery)
+	if err != nil {
+		errorLog.Println("GroupAll MSGraph request failed:", err)
+		return nil, err
+	}
+	scope, err := d.groupScope()
+	if err != nil {
+		return nil, err
+	}
+	groups = scopedGroups(groups, scope)
+	if err := d.resolveAllMembers(groups); err != nil {
+		return nil, err
+	}
+
+	groupResult := d.groupEntries(groups, nil)
+	if d.config.UserPrivateGroups {
+		passwd, err := d.PasswdAll()
+		if err != nil {
+			return nil, err
+		}
+		groupResult = append(groupResult, d.PrivateGroups(passwd)...)
+	}
+	return groupResult, nil
+}
+
+// groupEntries converts groups to group entries. Missing GIDs are allocated
+// where allowed and reported to assigned, otherwise the group is left out.
+// Groups losing their name to another of groups are left out too.
+func (d *Directory) groupEntries(groups []graph.Group, assigned func(graph.Group, uint)) []nssStructs.Group {
+	return d.convertGroups(groups, d.config.GroupAutoGID && d.writable, assigned, nil)
+}
+
+// knownGroupEntries converts groups to group entries like groupEntries, but
+// never writes to Azure AD: groups without a GID are left out. Hashed GIDs
+// are checked against gids, or against groups when it is nil.
+func (d *Directory) knownGroupEntries(groups []graph.Group, gids *idIndex) []nssStructs.Group {
+	return d.convertGroups(groups, false, nil, gids)
+}
+
+// convertGroups converts groups to group entries, allocating missing GIDs when allocate is set
+func (d *Directory) convertGroups(groups []graph.Group, allocate bool, assigned func(graph.Group, uint), gids *idIndex) []nssStructs.Group {
+
+	//Open Slice/Struct for result
+	groupResult := []nssStructs.Group{}
+
+	if gids == nil && d.hashMapping() {
+		gids = d.groupIDs(groups)
+	}
+	for _, group := range d.uniqueGroupNames(groups) {
+		tempGroup, hasGID, err := d.groupToNss(group)
+		if err != nil {
+			errorLog.Println("Skipping group", group.DisplayName, err)
+			continue
+		}
+		if !hasGID && allocate {
+			tempGroup.GID, err = d.AutoSetGID(group.ID)
+			if err != nil {
+				continue
+			}
+			if assigned != nil {
+				assigned(group, tempGroup.GID)
+			}
+		} else if !hasGID {
+			continue
+		}
+		if gids != nil && !gids.owns(group.ID, tempGroup.GID, d.hashedGID(group)) {
+			errorLog.Printf("GID %d of %s is shared with another group, skipping. Set a GID attribute on one of them to resolve", tempGroup.GID, tempGroup.Groupname)
+			continue
+		}
+		groupResult = append(groupResult, tempGroup)
+	}
+
+	return mergeMappedGroups(groupResult)
+}
+
+// GroupByName returns a single security group by name
+func (d *Directory) GroupByName(name string) (nssStructs.Group, error) {
+
+	debugLog.Println("GroupByName Query:", name) //DEBUG
+	if d.isMappedName(name) {
+		return d.mappedGroupByName(name)
+	}
+	group, err := d.groupByName(name)
+	if IsNotFound(err) {
+		return d.privateGroupByName(name)
+	}
+	if err != nil {
+		errorLog.Println("GroupByName MSGraph request failed:", err)
+		return nssStructs.Group{}, err
+	}
+	if err := d.resolveMembers(&group); err != nil {
+		return nssStructs.Group{}, err
+	}
+	groupResult, hasGID, err := d.groupToNss(group)
+	if err != nil {
+		errorLog.Println("GroupByName invalid group", name, err)
+		return nssStructs.Group{}, err
+	}
+	if d.hashedGID(group) {
+		if owns, err := d.ownsGID(group.ID, groupResult.GID); err != nil || !owns {
+			return nssStructs.Group{}, notInScope(err)
+		}
+	}
+	if hasGID {
+		return groupResult, nil
+	} else if d.config.GroupAutoGID && d.writable {
+		groupResult.GID, err = d.AutoSetGID(group.ID)
+		if err != nil {
+			return nssStructs.Group{}, err
+		}
+		return groupResult, nil
+	}
+	return d.privateGroupByName(name)
+
+}
+
+// GroupByGid returns a single security group by GID
+func (d *Directory) GroupByGid(gid uint) (nssStructs.Group, error) {
+
+	//Local groups Azure AD groups are mapped to
+	if name, ok := d.mappedName(gid); ok {
+		return d.mappedGroupByName(name)
+	}
+
+	group, err := d.groupByGID(gid)
+	if IsNotFound(err) {
+		return d.privateGroupByGid(gid)
+	}
+	if err != nil {
+		return nssStructs.Group{}, err
+	}
+	if inScope, err := d.groupInScope(group.ID); err != nil || !inScope {
+		return nssStructs.Group{}, notInScope(err)
+	}
+	if owns, err := d.ownsGroupName(group); err != nil || !owns {
+		return nssStructs.Group{}, notInScope(err)
+	}
+	if err := d.resolveMembers(&group); err != nil {
+		return nssStructs.Group{}, err
+	}
+	groupResult, _, err := d.groupToNss(group)
+	if err != nil {
+		return nssStructs.Group{}, err
+	}
+	groupResult.Members = d.memberNames(group.Members)
+	return groupResult, nil
+}
+
+// groupByGID returns the group holding gid, in an attribute or hashed
+func (d *Directory) groupByGID(gid uint) (graph.Group, error) {
+	if d.config.GroupGidAttribute != "" {
+		//Search for group by GID
+		getGroupQuery := "v1.0/groups?$count=true&" + membersExpand + "&$select=" + d.groupSelect() + filterParam(d.idAttributes().GroupGIDFilter(gid), d.groupFilter())
+		debugLog.Println("GroupByGid Query:", gid) //DEBUG
+		groups, err := d.client.GetGroups(getGroupQuery)
+		if err != nil {
+			errorLog.Println("GroupByGid MSGraph request failed:", err)
+			return graph.Group{}, err
+		}
+		for _, group := range groups {
+			groupResult, hasGID, err := d.groupToNss(group)
+			if err != nil {
+				errorLog.Println("GroupByGid invalid group", group.DisplayName, err)
+				continue
+			}
+			if hasGID && groupResult.GID == gid {
+				return group, nil
+			}
+		}
+	}
+	if !d.hashMapping() {
+		return graph.Group{}, ErrNotFound
+	}
+
+	//Hashed GIDs are not stored in Azure AD so cannot be filtered on, the
+	//index maps them back to the group
+	gids, err := d.visibleGroupIDs()
+	if err != nil {
+		return graph.Group{}, err
+	}
+	id, ok := gids.hashedOwner(gid)
+	if !ok {
+		return graph.Group{}, ErrNotFound
+	}
+	var group graph.Group
+	if err := d.client.Get("v1.0/groups/"+url.PathEscape(id)+"?"+membersExpand+"&$select="+d.groupSelect(), &group); err != nil {
+		errorLog.Println("GroupByGid MSGraph request failed:", err)
+		return graph.Group{}, err
+	}
+	//The group may have been given a GID attribute since the index was read
+	if groupResult, _, err := d.groupToNss(group); err != nil || !d.hashedGID(group) || groupResult.GID != gid {
+		return graph.Group{}, ErrNotFound
+	}
+	return group, nil
+}
+
+// InitGroups returns the GIDs of the groups a user belongs to, including
+// through nested groups when group-nested-members is set. It answers
+// initgroups without expanding the members of every group, and never
+// allocates GIDs: logins do not write to Azure AD.
+func (d *Directory) InitGroups(name string) ([]uint, error) {
+
+	debugLog.Println("InitGroups Query:", name) //DEBUG
+	var user graph.User
+	err := d.getUserByName(name, d.userSelect(), &user)
+	if err != nil {
+		errorLog.Println("InitGroups MSGraph request failed:", err)
+		return nil, err
+	}
+	if inScope, err := d.userInScope(user); err != nil || !inScope {
+		return nil, notInScope(err)
+	}
+
+	relation := "memberOf"
+	if d.config.GroupNestedMembers {
+		relation = "transitiveMemberOf"
+	}
+	getGroupQuery := "v1.0/users/" + user.ID + "/" + relation + "/microsoft.graph.group?$count=true&$select=" + d.groupSelect() + filterParam(d.groupFilter())
+	groups, err := d.client.GetGroups(getGroupQuery)
+	if err != nil {
+		errorLog.Println("InitGroups MSGraph request failed:", err)
+		return nil, err
+	}
+	scope, err := d.groupScope()
+	if err != nil {
+		return nil, err
+	}
+	groups = scopedGroups(groups, scope)
+
+	//Groups losing their name or GID to a group the user is not in are left
+	//out, the same as in enumerations, so read the groups they may lose to
+	list, err := d.visibleGroupList()
+	if err != nil {
+		return nil, err
+	}
+
+	//GIDs are never allocated at login, groups without one are left out
+	owned := map[string]uint{}
+	for _, group := range d.knownGroupEntries(unionGroups(groups, list.groups), list.gids) {
+		owned[group.Groupname] = group.GID
+	}
+	gids := []uint{}
+	seen := map[uint]bool{}
+	for _, group := range groups {
+		entry, hasGID, err := d.groupToNss(group)
+		if err != nil || !hasGID {
+			continue
+		}
+		if gid, ok := owned[entry.Groupname]; ok && gid == entry.GID && !seen[gid] {
+			seen[gid] = true
+			gids = append(gids, gid)
+		}
+	}
+	return gids, nil
+}
+
+// unionGroups returns the groups in a and b, each group once
+func unionGroups(a []graph.Group, b []graph.Group) []graph.Group {
+	result := []graph.Group{}
+	seen := map[string]bool{}
+	for _, group := range append(append([]graph.Group{}, a...), b...) {
+		if !seen[group.ID] {
+			seen[group.ID] = true
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// ShadowAll returns shadow entries for all users, passwords are never exposed
+func (d *Directory) ShadowAll() ([]nssStructs.Shadow, error) {
+
+	//Build all users query. Filters out users not in scope and only returns required fields.
+	getUserQuery := "v1.0/users?$count=true&$select=" + shadowSelect + filterParam(d.userFilter())
+	debugLog.Println("ShadowAll Query") //DEBUG
+
+	users, err := d.client.GetUsers(getUserQuery)
+	if err != nil {
+		errorLog.Println("ShadowAll MSGraph request failed:", err)
+		return nil, err
+	}
+	scope, err := d.userScope()
+	if err != nil {
+		return nil, err
+	}
+	users = scopedUsers(users, scope)
+
+	return d.shadowEntries(users), nil
+}
+
+// ShadowByName returns the shadow entry for a single user
+func (d *Directory) ShadowByName(name string) (nssStructs.Shadow, error) {
+
+	//Build user query, only returns required fields
+	debugLog.Println("ShadowByName Query:", name) //DEBUG
+
+	var user graph.User
+	err := d.getUserByName(name, shadowSelect, &user)
+	if err != nil {
+		errorLog.Println("ShadowByName MSGraph request failed:", err)
+		return nssStructs.Shadow{}, err
+	}
+	if inScope, err := d.userInScope(user); err != nil || !inScope {
+		return nssStructs.Shadow{}, notInScope(err)
+	}
+
+	shadowResult, _ := d.userToShadow(user)
+	return shadowResult, nil
+}
+
+// shadowEntries converts users to shadow entries
+func (d *Directory) shadowEntries(users []graph.User) []nssStructs.Shadow {
+
+	//Open Slice/Struct for result
+	shadowResult := []nssStructs.Shadow{}
+
+	names := []string{}
+	for _, user := range users {
+		if shadow, ok := d.userToShadow(user); ok {
+			shadowResult = append(shadowResult, shadow)
+			names = append(names, shadow.Username)
+		}
+	}
+
+	//Leave out the same users as passwd
+	shared := sharedNames(names)
+	if len(shared) == 0 {
+		return shadowResult
+	}
+	result := []nssStructs.Shadow{}
+	for _, shadow := range shadowResult {
+		if shared[shadow.Username] == 0 {
+			result = append(result, shadow)
+		}
+	}
+	return result
+}
@@ -0,0 +1,348 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// Where group names are read from. Any other group-name-attribute is a
+// directory extension.
+const (
+	//The default
+	GroupNameDisplayName  = "displayName"
+	GroupNameMailNickname = "mailNickname"
+	//The name synced from on-premises AD
+	GroupNameSamAccountName = "onPremisesSamAccountName"
+)
+
+// The attribute group names are read from
+func (d *Directory) groupNameAttribute() string {
+	if d.config.GroupNameAttribute != "" {
+		return d.config.GroupNameAttribute
+	}
+	return GroupNameDisplayName
+}
+
+// $select fields needed to name groups
+func (d *Directory) groupNameSelect() string {
+	if attribute := d.groupNameAttribute(); attribute != GroupNameDisplayName {
+		return "id,displayName," + attribute
+	}
+	return "id,displayName"
+}
+
+// $select fields needed to build group entries, without members
+func (d *Directory) groupSelect() string {
+	return d.groupNameSelect() + "," + d.config.GroupGidAttribute
+}
+
+// rawGroupName returns the group-name-attribute of a group as stored in
+// Azure AD. Groups without it fall back to their display name.
+func (d *Directory) rawGroupName(g graph.Group) string {
+	name := ""
+	switch attribute := d.groupNameAttribute(); attribute {
+	case GroupNameDisplayName:
+		name = g.DisplayName
+	case GroupNameMailNickname:
+		name = g.MailNickname
+	case GroupNameSamAccountName:
+		name = g.OnPremisesSamAccountName
+	default:
+		if raw := g.Attributes[attribute]; len(raw) != 0 && json.Unmarshal(raw, &name) != nil {
+			name = ""
+		}
+	}
+	if name == "" {
+		name = g.DisplayName
+	}
+	return name
+}
+
+// groupName returns the name of a group, empty when it has no usable name
+func (d *Directory) groupName(g graph.Group) string {
+	name := d.rawGroupName(g)
+	if d.config.GroupNameRaw {
+		return name
+	}
+	return sanitizeGroupName(name)
+}
+
+// Lowercase Latin letters with diacritics, folded to ASCII rather than
+// replaced so "Müller" is muller
+var foldLatin = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ą", "a", "æ", "ae",
+	"ç", "c", "ć", "c", "č", "c", "ď", "d", "ð", "d",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ę", "e", "ě", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ł", "l", "ñ", "n", "ń", "n", "ň", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "ő", "o", "œ", "oe",
+	"ř", "r", "ś", "s", "š", "s", "ß", "ss", "ť", "t", "þ", "th",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ů", "u", "ű", "u",
+	"ý", "y", "ÿ", "y", "ź", "z", "ż", "z", "ž", "z",
+)
+
+// sanitizeGroupName turns an Azure AD name into a POSIX group name: lowercase
+// ASCII letters, digits, "_", "." and "-", starting with a letter or "_".
+// Accented Latin letters lose their accents. Each run of other characters,
+// spaces and colons included, becomes a single "-", so "Linux Admins" is
+// linux-admins. Names starting with a digit are prefixed with "_" so they are
+// never taken for a GID. Names with nothing usable in them, all Unicode say,
+// sanitize to "".
+func sanitizeGroupName(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range foldLatin.Replace(strings.ToLower(name)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '.':
+			b.WriteRune(r)
+			dash = false
+		case b.Len() != 0 && !dash:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	sanitized := strings.Trim(b.String(), "-.")
+	if sanitized == "" {
+		return ""
+	}
+	if c := sanitized[0]; c >= '0' && c <= '9' {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+// groupNameOwners returns the ID of the group owning each name. Where groups
+// collide a group whose stored name already is the name wins, so an existing
+// "linux-admins" keeps its name over "Linux Admins". Between groups that are
+// otherwise equal the lowest object ID wins. Groups that lose are logged and
+// left out, the same result whichever order they are read in.
+func (d *Directory) groupNameOwners(groups []graph.Group) map[string]string {
+	owners := map[string]graph.Group{}
+	for _, group := range groups {
+		name := d.groupName(group)
+		if name == "" {
+			continue
+		}
+		owner, taken := owners[name]
+		if !taken {
+			owners[name] = group
+			continue
+		}
+		winner, loser := owner, group
+		if d.beatsForName(name, group, owner) {
+			winner, loser = group, owner
+		}
+		owners[name] = winner
+		errorLog.Printf("Group name %s is used by groups %s and %s, skipping %s (%s). Rename the group or change group-name-attribute to resolve", name, winner.ID, loser.ID, loser.ID, loser.DisplayName)
+	}
+	ids := map[string]string{}
+	for name, group := range owners {
+		ids[name] = group.ID
+	}
+	return ids
+}
+
+// Whether group a wins name over group b
+func (d *Directory) beatsForName(name string, a graph.Group, b graph.Group) bool {
+	aExact, bExact := d.rawGroupName(a) == name, d.rawGroupName(b) == name
+	if aExact != bExact {
+		return aExact
+	}
+	return a.ID < b.ID
+}
+
+// uniqueGroupNames leaves out groups without a name and groups that lose
+// their name to another group, see groupNameOwners. Groups in group-mappings
+// are kept, and take their local group's name from any other group.
+func (d *Directory) uniqueGroupNames(groups []graph.Group) []graph.Group {
+	unmapped := []graph.Group{}
+	for _, group := range groups {
+		if _, _, ok := d.mappedGroup(group.ID); !ok {
+			unmapped = append(unmapped, group)
+		}
+	}
+	owners := d.groupNameOwners(unmapped)
+	result := []graph.Group{}
+	for _, group := range groups {
+		if _, _, ok := d.mappedGroup(group.ID); ok {
+			result = append(result, group)
+			continue
+		}
+		name := d.groupName(group)
+		if name == "" {
+			debugLog.Println("No usable group name for", group.ID, group.DisplayName)
+			continue
+		}
+		if d.isMappedName(name) {
+			errorLog.Printf("Group %s (%s) is named after local group %s, which group-mappings maps other groups to, skipping", group.ID, group.DisplayName, name)
+			continue
+		}
+		if owners[name] == group.ID {
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// groupByName returns the visible group owning name, with its members, see
+// nameOwner
+func (d *Directory) groupByName(name string) (graph.Group, error) {
+	return d.nameOwner(name, true)
+}
+
+// nameOwner returns the visible group owning name, with its members when
+// members is set. Groups whose stored name is name win over any group
+// sanitized into it, and are found with a filter in a single request. Other
+// groups can only own name once sanitized, which cannot be filtered on: the
+// stored name may start with anything sanitizing drops or folds, such as
+// "[Ops] Admins" or "Équipe". So only then is the owner found among every
+// visible group, see visibleGroupList, decided the way enumerations decide it.
+func (d *Directory) nameOwner(name string, members bool) (graph.Group, error) {
+	if name == "" || (!d.config.GroupNameRaw && sanitizeGroupName(name) != name) {
+		//Not a name any group can have
+		return graph.Group{}, ErrNotFound
+	}
+	if d.isMappedName(name) {
+		//Belongs to the groups mapped to the local group
+		return graph.Group{}, ErrNotFound
+	}
+	expand := ""
+	if members {
+		expand = membersExpand + "&"
+	}
+
+	//Groups without group-name-attribute fall back to their display name
+	exact := d.groupNameAttribute() + "+eq+" + odataString(name)
+	if d.groupNameAttribute() != GroupNameDisplayName {
+		exact = exact + "+or+displayName+eq+" + odataString(name)
+	}
+	getGroupQuery := "v1.0/groups?$count=true&" + expand + "$select=" + d.groupSelect() + filterParam(exact, d.groupFilter())
+	debugLog.Println("Group Name Query:", name) //DEBUG
+	groups, err := d.client.GetGroups(getGroupQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return graph.Group{}, err
+	}
+	//eq ignores case, stored names must match exactly
+	matches := []graph.Group{}
+	for _, group := range groups {
+		if d.rawGroupName(group) == name && d.groupName(group) == name {
+			matches = append(matches, group)
+		}
+	}
+	group, err := d.visibleOwner(name, matches)
+	if !IsNotFound(err) || d.config.GroupNameRaw {
+		return group, err
+	}
+
+	list, err := d.visibleGroupList()
+	if err != nil {
+		return graph.Group{}, err
+	}
+	id, ok := list.owners[name]
+	if !ok {
+		return graph.Group{}, ErrNotFound
+	}
+	getGroupQuery = "v1.0/groups/" + url.PathEscape(id) + "?" + expand + "$select=" + d.groupSelect()
+	debugLog.Println("Group Query:", id) //DEBUG
+	if err := d.client.Get(getGroupQuery, &group); err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return graph.Group{}, err
+	}
+	//Renamed since the list was read
+	if d.groupName(group) != name {
+		return graph.Group{}, ErrNotFound
+	}
+	return group, nil
+}
+
+// groupList is every visible group, without members, and the owner of each
+// of their names
+type groupList struct {
+	groups []graph.Group
+	//ID of the group owning each name, see groupNameOwners
+	owners map[string]string
+	//GIDs of the groups, with hash mapping
+	gids  *idIndex
+	built time.Time
+}
+
+// Visible groups, shared by the lookups of this process
+var groupsList *groupList
+
+// visibleGroupList returns every visible group, read with only the fields
+// naming them and their GID attribute. The list is reused for idIndexTTL.
+func (d *Directory) visibleGroupList() (*groupList, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if groupsList != nil && time.Since(groupsList.built) < idIndexTTL {
+		return groupsList, nil
+	}
+	getGroupQuery := "v1.0/groups?$count=true&$select=" + d.groupSelect() + filterParam(d.groupFilter())
+	debugLog.Println("Visible Groups Query") //DEBUG
+	groups, err := d.client.GetGroups(getGroupQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+	scope, err := d.groupScope()
+	if err != nil {
+		return nil, err
+	}
+	groups = scopedGroups(groups, scope)
+	unmapped := []graph.Group{}
+	for _, group := range groups {
+		if _, _, ok := d.mappedGroup(group.ID); !ok {
+			unmapped = append(unmapped, group)
+		}
+	}
+	groupsList = &groupList{groups: groups, owners: d.groupNameOwners(unmapped), built: time.Now()}
+	if d.hashMapping() {
+		groupsList.gids = d.groupIDs(groups)
+	}
+	return groupsList, nil
+}
+
+// visibleOwner returns the visible group among groups, all named name, that
+// owns the name. Groups outside the group scope never own a name.
+func (d *Directory) visibleOwner(name string, groups []graph.Group) (graph.Group, error) {
+	visible := []graph.Group{}
+	for _, group := range groups {
+		inScope, err := d.groupInScope(group.ID)
+		if err != nil {
+			return graph.Group{}, err
+		}
+		if inScope {
+			visible = append(visible, group)
+		}
+	}
+	if id, ok := d.groupNameOwners(visible)[name]; ok {
+		for _, group := range visible {
+			if group.ID == id {
+				return group, nil
+			}
+		}
+	}
+	return graph.Group{}, ErrNotFound
+}
+
+// ownsGroupName reports whether g, a visible group, owns its name. A group
+// losing its name to another group is not found by GID either.
+func (d *Directory) ownsGroupName(g graph.Group) (bool, error) {
+	name := d.groupName(g)
+	if name == "" || d.isMappedName(name) {
+		return false, nil
+	}
+	owner, err := d.nameOwner(name, false)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return owner.ID == g.ID, err
+}
+
+// errNoGroupName is returned for groups whose name sanitizes to nothing
+var errNoGroupName = fmt.Errorf("%w: no usable group name", ErrNotFound)
@@ -0,0 +1,228 @@
+package directory
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/graph"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// fakeGroups stands in for Graph holding groups with a display name and GID.
+// Filters on the display name are matched ignoring case, like Graph does, any
+// other filter matches every group.
+type fakeGroups struct {
+	groups []map[string]interface{}
+	//Collection queries not filtering on the display name
+	listed int
+}
+
+var displayNameEq = regexp.MustCompile(`displayName eq '((?:[^']|'')*)'`)
+
+func (f *fakeGroups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1.0/groups":
+		names := displayNameEq.FindAllStringSubmatch(r.URL.Query().Get("$filter"), -1)
+		if len(names) == 0 {
+			f.listed++
+		}
+		result := []map[string]interface{}{}
+		for _, g := range f.groups {
+			matched := len(names) == 0
+			for _, name := range names {
+				if strings.EqualFold(g["displayName"].(string), strings.ReplaceAll(name[1], "''", "'")) {
+					matched = true
+				}
+			}
+			if matched {
+				result = append(result, g)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": result})
+
+	case strings.HasPrefix(r.URL.Path, "/v1.0/groups/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1.0/groups/")
+		for _, g := range f.groups {
+			if g["id"] == id {
+				json.NewEncoder(w).Encode(g)
+				return
+			}
+		}
+		http.Error(w, `{"error":{"code":"Request_ResourceNotFound"}}`, http.StatusNotFound)
+
+	default:
+		http.Error(w, "unexpected request "+r.URL.String(), http.StatusNotFound)
+	}
+}
+
+// Lookups by name find the same group as GroupAll for names no prefix of the
+// stored name can be searched for: stored names starting with punctuation or
+// an accented letter, and names shared by such a group
+func TestGroupByNameSanitized(t *testing.T) {
+	fake := &fakeGroups{groups: []map[string]interface{}{
+		{"id": "2222", "displayName": "Ops: Admins", "gidNumber": 60002},
+		{"id": "1111", "displayName": "[Ops] Admins", "gidNumber": 60001},
+		{"id": "3333", "displayName": "Équipe", "gidNumber": 60003},
+		{"id": "4444", "displayName": "linux-admins", "gidNumber": 60004},
+		{"id": "5555", "displayName": "Linux Admins", "gidNumber": 60005},
+	}}
+	d := newTestDirectory(t, &conf.Config{UsernameMapping: MappingUPN, GroupGidAttribute: "gidNumber"}, fake)
+
+	all, err := d.GroupAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enumerated := map[string]nssStructs.Group{}
+	for _, g := range all {
+		enumerated[g.Groupname] = g
+	}
+
+	tests := []struct {
+		name string
+		gid  uint
+	}{
+		//The lowest object ID wins between sanitized names
+		{"ops-admins", 60001},
+		{"equipe", 60003},
+		//A stored name that already is the name wins
+		{"linux-admins", 60004},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := enumerated[tt.name].GID; got != tt.gid {
+				t.Errorf("GroupAll gave %s GID %d, want %d", tt.name, got, tt.gid)
+			}
+			g, err := d.GroupByName(tt.name)
+			if err != nil {
+				t.Fatalf("GroupByName(%s) failed: %v", tt.name, err)
+			}
+			if g.GID != tt.gid {
+				t.Errorf("GroupByName(%s) GID %d, want %d", tt.name, g.GID, tt.gid)
+			}
+			if g, err := d.GroupByGid(tt.gid); err != nil || g.Groupname != tt.name {
+				t.Errorf("GroupByGid(%d) = %s, %v, want %s", tt.gid, g.Groupname, err, tt.name)
+			}
+		})
+	}
+
+	//Groups losing their name are not found by GID either
+	for _, gid := range []uint{60002, 60005} {
+		if _, err := d.GroupByGid(gid); !IsNotFound(err) {
+			t.Errorf("GroupByGid(%d) got %v, want not found like GroupAll", gid, err)
+		}
+	}
+
+	//A name held under its stored name is decided without listing every group
+	fake.listed = 0
+	if _, err := d.GroupByName("linux-admins"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.listed != 0 {
+		t.Errorf("listed groups %d times for a stored name, want 0", fake.listed)
+	}
+}
+
+var sanitizeTests = []struct {
+	raw  string
+	want string
+}{
+	{"linux-admins", "linux-admins"},
+	{"Linux Admins", "linux-admins"},
+	{"Ops: Admins", "ops-admins"},
+	{"[Ops] Admins", "ops-admins"},
+	{"A & B", "a-b"},
+	{"  Spaced  Out  ", "spaced-out"},
+	{"Foo_Bar.Baz", "foo_bar.baz"},
+	{".hidden.", "hidden"},
+	{"Müller Team", "muller-team"},
+	{"Équipe", "equipe"},
+	{"Straße", "strasse"},
+	{"Æsir", "aesir"},
+	{"2024: Staff", "_2024-staff"},
+	{"#1 Team", "_1-team"},
+	{"日本", ""},
+	{"---", ""},
+}
+
+func TestSanitizeGroupName(t *testing.T) {
+	for _, tt := range sanitizeTests {
+		if got := sanitizeGroupName(tt.raw); got != tt.want {
+			t.Errorf("sanitizeGroupName(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+		//Sanitized names are left as they are
+		if got := sanitizeGroupName(tt.want); got != tt.want {
+			t.Errorf("sanitizeGroupName(%q) = %q, want it unchanged", tt.want, got)
+		}
+	}
+}
+
+// Every group is found by the name it sanitizes to, whatever its stored name starts with
+func TestGroupByNameReverse(t *testing.T) {
+	for _, tt := range sanitizeTests {
+		if tt.want == "" {
+			continue
+		}
+		t.Run(tt.raw, func(t *testing.T) {
+			fake := &fakeGroups{groups: []map[string]interface{}{
+				{"id": "1111", "displayName": tt.raw, "gidNumber": 60001},
+				{"id": "2222", "displayName": "Unrelated", "gidNumber": 60002},
+			}}
+			d := newTestDirectory(t, &conf.Config{UsernameMapping: MappingUPN, GroupGidAttribute: "gidNumber"}, fake)
+			g, err := d.GroupByName(tt.want)
+			if err != nil {
+				t.Fatalf("GroupByName(%s) failed: %v", tt.want, err)
+			}
+			if g.GID != 60001 {
+				t.Errorf("GroupByName(%s) GID %d, want 60001", tt.want, g.GID)
+			}
+		})
+	}
+}
+
+func TestGroupNameOwners(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []graph.Group
+		want   map[string]string
+	}{
+		{"sanitized names, lowest ID wins", []graph.Group{
+			{ID: "2222", DisplayName: "Ops: Admins"},
+			{ID: "1111", DisplayName: "[Ops] Admins"},
+		}, map[string]string{"ops-admins": "1111"}},
+		{"stored name wins over a lower ID", []graph.Group{
+			{ID: "1111", DisplayName: "Linux Admins"},
+			{ID: "2222", DisplayName: "linux-admins"},
+		}, map[string]string{"linux-admins": "2222"}},
+		{"same stored name, lowest ID wins", []graph.Group{
+			{ID: "2222", DisplayName: "staff"},
+			{ID: "1111", DisplayName: "staff"},
+			{ID: "0000", DisplayName: "Staff"},
+		}, map[string]string{"staff": "1111"}},
+		{"unusable names have no owner", []graph.Group{
+			{ID: "1111", DisplayName: "日本"},
+			{ID: "2222", DisplayName: "Équipe"},
+		}, map[string]string{"equipe": "2222"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Directory{config: &conf.Config{}}
+			if got := d.groupNameOwners(tt.groups); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("owners %v, want %v", got, tt.want)
+			}
+			//The order groups are read in makes no difference
+			reversed := []graph.Group{}
+			for i := len(tt.groups) - 1; i >= 0; i-- {
+				reversed = append(reversed, tt.groups[i])
+			}
+			if got := d.groupNameOwners(reversed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("owners read in reverse %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
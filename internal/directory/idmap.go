@@ -0,0 +1,218 @@
+package directory
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// ID mapping modes
+const (
+	//IDs are read from, and allocated into, attributes in Azure AD
+	IDMappingAttribute = "attribute"
+	//Missing IDs are derived from object IDs, nothing is written to Azure AD
+	IDMappingHash = "hash"
+)
+
+// Default hash mapping range, the same as sssd's ldap_idmap_range_min/max
+const (
+	defaultIDMappingMin = 200000
+	defaultIDMappingMax = 2000200000
+)
+
+// hashMapping reports whether missing IDs are derived from object IDs
+func (d *Directory) hashMapping() bool {
+	return d.config.IDMapping == IDMappingHash
+}
+
+// hashID derives a UID or GID from an Azure AD object ID. The range is split
+// into slices of id-mapping-slice-size, the tenant picks the slice and the
+// object its place within it, so every host maps an object to the same ID.
+func (d *Directory) hashID(objectID string) uint {
+	min, max := d.config.IDMappingMin, d.config.IDMappingMax
+	if min <= 0 || max <= min {
+		min, max = defaultIDMappingMin, defaultIDMappingMax
+	}
+	size := uint64(max - min + 1)
+	sliceSize := uint64(d.config.IDMappingSliceSize)
+	if sliceSize == 0 || sliceSize > size {
+		sliceSize = size
+	}
+	slice := hash64(d.config.TenantID) % (size / sliceSize)
+	return uint(uint64(min) + slice*sliceSize + hash64(objectID)%sliceSize)
+}
+
+// hash64 is a case insensitive FNV-1a hash, GUIDs are compared without case
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(s)))
+	return h.Sum64()
+}
+
+// How long single lookups reuse the IDs of every visible user or group
+// before reading them again
+var idIndexTTL = 5 * time.Minute
+
+// idIndex records which objects hold each UID or GID, so single lookups apply
+// the same collision rules as enumerations without reading every entry
+type idIndex struct {
+	//Object IDs holding each ID, set in an attribute or hashed
+	holders map[uint][]string
+	//Object IDs whose ID is hashed
+	hashed map[string]bool
+	built  time.Time
+}
+
+func newIDIndex() *idIndex {
+	return &idIndex{holders: map[uint][]string{}, hashed: map[string]bool{}, built: time.Now()}
+}
+
+func (ix *idIndex) add(objectID string, id uint, hashed bool) {
+	ix.holders[id] = append(ix.holders[id], objectID)
+	if hashed {
+		ix.hashed[objectID] = true
+	}
+}
+
+// owns reports whether objectID keeps id. IDs set in attributes always do,
+// setting one is how a collision is resolved. A hashed ID is only kept when
+// no other object holds it: handing two people the same UID would give each
+// access to the other's files.
+func (ix *idIndex) owns(objectID string, id uint, hashed bool) bool {
+	if !hashed {
+		return true
+	}
+	for _, holder := range ix.holders[id] {
+		if holder != objectID {
+			return false
+		}
+	}
+	return true
+}
+
+// hashedOwner returns the object keeping the hashed ID id
+func (ix *idIndex) hashedOwner(id uint) (string, bool) {
+	if holders := ix.holders[id]; len(holders) == 1 && ix.hashed[holders[0]] {
+		return holders[0], true
+	}
+	return "", false
+}
+
+// hashedUID reports whether the UID of u is derived from its object ID
+func (d *Directory) hashedUID(u graph.User) bool {
+	_, ok, err := d.idAttributes().UserUID(u)
+	return d.hashMapping() && err == nil && !ok
+}
+
+// hashedGID reports whether the GID of g is derived from its object ID
+func (d *Directory) hashedGID(g graph.Group) bool {
+	if _, _, mapped := d.mappedGroup(g.ID); mapped {
+		return false
+	}
+	_, ok, err := d.idAttributes().GroupGID(g)
+	return d.hashMapping() && err == nil && !ok
+}
+
+// userIDs indexes the UIDs of users
+func (d *Directory) userIDs(users []graph.User) *idIndex {
+	attrs := d.idAttributes()
+	ix := newIDIndex()
+	for _, u := range users {
+		uid, ok, err := attrs.UserUID(u)
+		if err != nil {
+			continue
+		}
+		if ok {
+			ix.add(u.ID, uid, false)
+		} else {
+			ix.add(u.ID, d.hashID(u.ID), true)
+		}
+	}
+	return ix
+}
+
+// groupIDs indexes the GIDs of groups
+func (d *Directory) groupIDs(groups []graph.Group) *idIndex {
+	attrs := d.idAttributes()
+	ix := newIDIndex()
+	for _, g := range groups {
+		if _, gid, mapped := d.mappedGroup(g.ID); mapped {
+			ix.add(g.ID, gid, false)
+			continue
+		}
+		gid, ok, err := attrs.GroupGID(g)
+		if err != nil {
+			continue
+		}
+		if ok {
+			ix.add(g.ID, gid, false)
+		} else {
+			ix.add(g.ID, d.hashID(g.ID), true)
+		}
+	}
+	return ix
+}
+
+// Index of every visible user, shared by the lookups of this process
+var (
+	indexMu    sync.Mutex
+	usersIndex *idIndex
+)
+
+// visibleUserIDs returns the index of the UIDs of every visible user. Only
+// object IDs and UID attributes are read, and the index is reused for
+// idIndexTTL.
+func (d *Directory) visibleUserIDs() (*idIndex, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if usersIndex != nil && time.Since(usersIndex.built) < idIndexTTL {
+		return usersIndex, nil
+	}
+	attrs := d.idAttributes()
+	getUserQuery := attrs.UserVersion() + "/users?$count=true&$select=id," + attrs.UserSelect() + filterParam(d.userFilter())
+	debugLog.Println("User IDs Query") //DEBUG
+	users, err := d.client.GetUsers(getUserQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+	scope, err := d.userScope()
+	if err != nil {
+		return nil, err
+	}
+	usersIndex = d.userIDs(scopedUsers(users, scope))
+	return usersIndex, nil
+}
+
+// visibleGroupIDs returns the index of the GIDs of every visible group, see
+// visibleGroupList
+func (d *Directory) visibleGroupIDs() (*idIndex, error) {
+	list, err := d.visibleGroupList()
+	if err != nil {
+		return nil, err
+	}
+	return list.gids, nil
+}
+
+// ownsUID reports whether the user objectID keeps its hashed UID uid. A user
+// left out of enumerations for sharing a UID must not be found on their own
+// either, or the two people sharing it are back.
+func (d *Directory) ownsUID(objectID string, uid uint) (bool, error) {
+	ix, err := d.visibleUserIDs()
+	if err != nil {
+		return false, err
+	}
+	return ix.owns(objectID, uid, true), nil
+}
+
+// ownsGID reports whether the group objectID keeps its hashed GID gid
+func (d *Directory) ownsGID(objectID string, gid uint) (bool, error) {
+	ix, err := d.visibleGroupIDs()
+	if err != nil {
+		return false, err
+	}
+	return ix.owns(objectID, gid, true), nil
+}
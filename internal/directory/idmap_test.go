@@ -0,0 +1,108 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/datty/pam-azuread/internal/conf"
+)
+
+// Hashed UIDs spread over three IDs: user0 hashes to the UID set in an
+// attribute, user1 and user2 to the same UID, user3 to one of its own. Single
+// lookups keep the same users as PasswdAll, and read the other users' IDs
+// once, without their other fields.
+func TestHashedUIDCollisions(t *testing.T) {
+	users := []map[string]interface{}{
+		{"id": "attr", "userPrincipalName": "attr@example.com", "uidNumber": 300000},
+	}
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("user%d", i)
+		users = append(users, map[string]interface{}{"id": id, "userPrincipalName": id + "@example.com"})
+	}
+
+	listed := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1.0/users" || r.URL.Path == "/v1.0/users/" {
+			//Every user, or those holding one UID
+			filter := r.URL.Query().Get("$filter")
+			byUID := strings.HasPrefix(filter, "uidNumber eq ")
+			if !byUID {
+				listed = append(listed, r.URL.Query().Get("$select"))
+			}
+			result := []map[string]interface{}{}
+			for _, u := range users {
+				if !byUID || filter == fmt.Sprintf("uidNumber eq %v", u["uidNumber"]) {
+					result = append(result, u)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": result})
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/v1.0/users/")
+		for _, u := range users {
+			if u["id"] == key || u["userPrincipalName"] == key {
+				json.NewEncoder(w).Encode(u)
+				return
+			}
+		}
+		http.Error(w, `{"error":{"code":"Request_ResourceNotFound"}}`, http.StatusNotFound)
+	})
+	d := newTestDirectory(t, &conf.Config{
+		UsernameMapping:       MappingUPN,
+		UserIncludeUnlicensed: true,
+		UserUIDAttribute:      "uidNumber",
+		IDMapping:             IDMappingHash,
+		IDMappingMin:          300000,
+		IDMappingMax:          300002,
+	}, handler)
+
+	all, err := d.PasswdAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]uint{}
+	byUID := map[uint]string{}
+	for _, p := range all {
+		byName[p.Username] = p.UID
+		byUID[p.UID] = p.Username
+	}
+	want := map[string]uint{"attr@example.com": 300000, "user3@example.com": 300002}
+	if !reflect.DeepEqual(byName, want) {
+		t.Errorf("PasswdAll kept %v, want %v", byName, want)
+	}
+	listed = nil
+
+	for _, u := range users {
+		name := u["userPrincipalName"].(string)
+		p, err := d.PasswdByName(name)
+		uid, kept := byName[name]
+		switch {
+		case kept && err != nil:
+			t.Errorf("PasswdByName(%s) failed: %v", name, err)
+		case kept && p.UID != uid:
+			t.Errorf("PasswdByName(%s) UID %d, want %d", name, p.UID, uid)
+		case !kept && !IsNotFound(err):
+			t.Errorf("PasswdByName(%s) got %v, want not found like PasswdAll", name, err)
+		}
+	}
+	for _, uid := range []uint{300000, 300001, 300002} {
+		p, err := d.PasswdByUid(uid)
+		name, kept := byUID[uid]
+		switch {
+		case kept && err != nil:
+			t.Errorf("PasswdByUid(%d) failed: %v", uid, err)
+		case kept && p.Username != name:
+			t.Errorf("PasswdByUid(%d) is %s, want %s", uid, p.Username, name)
+		case !kept && !IsNotFound(err):
+			t.Errorf("PasswdByUid(%d) got %v, want not found like PasswdAll", uid, err)
+		}
+	}
+
+	if len(listed) != 1 || listed[0] != "id,uidNumber" {
+		t.Errorf("single lookups listed users selecting %q, want once selecting only IDs", listed)
+	}
+}
@@ -0,0 +1,474 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// NobodyID is returned for users whose UID is not set and cannot be allocated
+const NobodyID = 65534
+
+// Allocation attempts before giving up, each attempt picks a new candidate ID
+const allocAttempts = 5
+
+// Time allowed for a write to reach the replicas that answer the read-back,
+// and how often the read-back is retried until it does
+var (
+	allocSettle = 2 * time.Second
+	allocPoll   = 200 * time.Millisecond
+)
+
+// How long after a write Azure AD queries are relied on to show every write
+// made before it. Owners of an allocated ID are only checked once this has
+// passed, so a host that wrote the same ID earlier is seen.
+var allocVerify = 5 * time.Second
+
+// ErrAllocationConflict is returned when every candidate ID was taken by another host first
+var ErrAllocationConflict = errors.New("unable to allocate an unused ID, lost every race with another host")
+
+// IDs handed out by this process. Azure AD is eventually consistent, so an ID
+// written moments ago may not show up in the next query for used IDs yet.
+var (
+	reserveMu    sync.Mutex
+	reservedUIDs = map[uint]bool{}
+	reservedGIDs = map[uint]bool{}
+)
+
+// Reserve an ID in reserved, false if it was already taken
+func reserve(reserved map[uint]bool, id uint) bool {
+	reserveMu.Lock()
+	defer reserveMu.Unlock()
+	if reserved[id] {
+		return false
+	}
+	reserved[id] = true
+	return true
+}
+
+// Add reserved IDs to a list of used IDs
+func withReserved(used []int, reserved map[uint]bool) []int {
+	reserveMu.Lock()
+	defer reserveMu.Unlock()
+	for id := range reserved {
+		used = append(used, int(id))
+	}
+	return used
+}
+
+// settle reads back a written ID until the write shows or allocSettle has
+// passed, returning the last value read. Azure AD is eventually consistent,
+// so the replica answering may not have the write yet.
+func settle(written uint, read func() (uint, bool, error)) (current uint, ok bool, err error) {
+	deadline := time.Now().Add(allocSettle)
+	for {
+		current, ok, err = read()
+		if err != nil || (ok && current == written) || !time.Now().Before(deadline) {
+			return current, ok, err
+		}
+		time.Sleep(allocPoll)
+	}
+}
+
+// claim checks an ID written to objectID at written is its alone. read
+// returns the object's ID and owners the objects holding an ID. Once the
+// write has been read back, claim waits until allocVerify after it, then any
+// other object holding the ID means another host wrote it too and id is lost.
+// Both hosts may see each other and lose, but one that wrote after the other
+// always sees the earlier write, so two hosts never both keep an ID.
+// When another host gave objectID an ID of its own, that ID is returned.
+func claim(objectID string, id uint, written time.Time, read func() (uint, bool, error), owners func(uint) ([]string, error)) (current uint, won bool, err error) {
+	current, ok, err := settle(id, read)
+	if err != nil {
+		return 0, false, err
+	}
+	if ok && current != id {
+		return current, true, nil
+	}
+
+	time.Sleep(time.Until(written.Add(allocVerify)))
+	holders, err := owners(id)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, holder := range holders {
+		if !strings.EqualFold(holder, objectID) {
+			return id, false, nil
+		}
+	}
+
+	//Another host may have given the object an ID since the read-back
+	current, ok, err = read()
+	if err != nil {
+		return 0, false, err
+	}
+	if ok && current != id {
+		return current, true, nil
+	}
+	return id, true, nil
+}
+
+// ID allocation strategies
+const (
+	//A random free ID in the range, the default
+	AllocRandom = "random"
+	//The lowest free ID in the range
+	AllocLowestFree = "lowest-free"
+	//One above the highest ID in use, the lowest free ID once the top of the range is reached
+	AllocNextAfterHighest = "next-after-highest"
+)
+
+// Warn once a range is this full, unless id-range-warn-percent is set
+const defaultRangeWarnPercent = 90
+
+// ErrRangeExhausted is returned when every ID in the UID or GID range is in use
+var ErrRangeExhausted = errors.New("no unused IDs left in range")
+
+// allocateID picks an ID between min and max that is neither used nor in a
+// reserved range, with the configured strategy. It runs in time bounded by the
+// number of used IDs and reserved ranges, not the size of the range.
+func (d *Directory) allocateID(used []int, reserved []idRange, min int, max int) (int, error) {
+
+	//Check Min/Max values are valid
+	if min == 0 || max == 0 {
+		errorLog.Println("Min/Max range is not set. Using default range 10000-15000")
+		min = 10000
+		max = 15000
+	}
+	if max < min {
+		return 0, fmt.Errorf("invalid ID range %d-%d", min, max)
+	}
+
+	//Everything taken, as sorted non-overlapping ranges within min-max
+	taken := append([]idRange{}, reserved...)
+	for _, id := range used {
+		taken = append(taken, idRange{id, id})
+	}
+	taken = mergeRanges(taken, min, max)
+
+	size := max - min + 1
+	inUse := 0
+	for _, r := range taken {
+		inUse += r.max - r.min + 1
+	}
+	free := size - inUse
+	if free == 0 {
+		errorLog.Printf("ID range %d-%d is exhausted, widen the range to allocate more IDs", min, max)
+		return 0, fmt.Errorf("%w %d-%d", ErrRangeExhausted, min, max)
+	}
+	warn := d.config.IDRangeWarnPercent
+	if warn <= 0 {
+		warn = defaultRangeWarnPercent
+	}
+	if inUse*100 >= size*warn {
+		warnLog.Printf("ID range %d-%d is %d%% full, %d IDs left", min, max, inUse*100/size, free)
+	}
+
+	var id int
+	switch d.config.IDAllocation {
+	case AllocLowestFree:
+		id = nthFree(taken, min, 0)
+	case AllocNextAfterHighest:
+		highest := min - 1
+		for _, u := range used {
+			if u >= min && u <= max && u > highest {
+				highest = u
+			}
+		}
+		id = freeFrom(taken, highest+1)
+		if id > max {
+			id = nthFree(taken, min, 0)
+		}
+	case AllocRandom, "":
+		rand.Seed(time.Now().UnixNano())
+		id = nthFree(taken, min, rand.Intn(free))
+	default:
+		return 0, fmt.Errorf("unknown id-allocation strategy %q", d.config.IDAllocation)
+	}
+	debugLog.Println("Allocated unused ID:", id) //DEBUG
+	return id, nil
+}
+
+// nthFree returns the nth (from zero) ID from min that is not in the sorted taken ranges
+func nthFree(taken []idRange, min int, n int) int {
+	id := min + n
+	for _, r := range taken {
+		if r.min > id {
+			break
+		}
+		id += r.max - r.min + 1
+	}
+	return id
+}
+
+// freeFrom returns the first ID from id up that is not in the sorted taken ranges
+func freeFrom(taken []idRange, id int) int {
+	for _, r := range taken {
+		if r.min <= id && id <= r.max {
+			id = r.max + 1
+		}
+	}
+	return id
+}
+
+// UIDs stored in Azure AD
+func (d *Directory) usedUIDs() ([]int, error) {
+	attrs := d.idAttributes()
+
+	//Build all users query. Every user counts, whether visible on this host or not. Only returns required fields.
+	getUIDQuery := attrs.UserVersion() + "/users?$count=true&$select=" + attrs.UserSelect()
+	debugLog.Println("Query:", getUIDQuery) //DEBUG
+	users, err := d.client.GetUsers(getUIDQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+
+	//Create empty uidlist
+	uidList := []int{}
+
+	//Collect existing uids
+	for _, user := range users {
+		uid, ok, err := attrs.UserUID(user)
+		if err != nil {
+			errorLog.Println("Invalid UID for user", user.ID, err)
+			continue
+		}
+		if ok {
+			uidList = append(uidList, int(uid))
+		}
+	}
+	return uidList, nil
+}
+
+// GIDs stored in Azure AD
+func (d *Directory) usedGIDs() ([]int, error) {
+	attrs := d.idAttributes()
+
+	//Build all groups query. Every group counts, whether visible on this host or not. Only returns required fields.
+	getGIDQuery := "v1.0/groups?$select=" + d.config.GroupGidAttribute
+	debugLog.Println("Query:", getGIDQuery) //DEBUG
+	groups, err := d.client.GetGroups(getGIDQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+
+	//Create empty gidlist
+	gidList := []int{}
+
+	//Collect existing gids
+	for _, group := range groups {
+		gid, ok, err := attrs.GroupGID(group)
+		if err != nil {
+			errorLog.Println("Invalid GID for group", group.ID, err)
+			continue
+		}
+		if ok {
+			gidList = append(gidList, int(gid))
+		}
+	}
+	return gidList, nil
+}
+
+// GetUnusedUID looks up existing UIDs and generates a unique UID
+func (d *Directory) GetUnusedUID() (output uint, err error) {
+	uidList, err := d.usedUIDs()
+	if err != nil {
+		return 0, err
+	}
+	//With private groups every UID is also a GID, so skip the GIDs of real groups
+	if d.config.UserPrivateGroups {
+		gidList, err := d.usedGIDs()
+		if err != nil {
+			return 0, err
+		}
+		uidList = append(uidList, gidList...)
+	}
+	//Never hand out a UID used by a local account on this host
+	uidList = append(uidList, localIDs(localPasswdFile)...)
+
+	reservedRanges, err := parseRanges(d.config.ReservedUIDRanges)
+	if err != nil {
+		return 0, err
+	}
+	newUID, err := d.allocateID(withReserved(uidList, reservedUIDs), reservedRanges, d.config.MinUID, d.config.MaxUID)
+	if err != nil {
+		return 0, err
+	}
+	return uint(newUID), nil
+}
+
+// AutoSetUID allocates an unused UID and writes it to the user in Azure AD.
+// The write is read back, then once Azure AD has caught up the users holding
+// the UID are checked to catch another host handing out the same UID at the
+// same time. A conflicting host retries with a new UID, and a user that loses
+// every attempt is left without a UID.
+func (d *Directory) AutoSetUID(userid string) (uid uint, err error) {
+	attrs := d.idAttributes()
+	userQuery := attrs.UserVersion() + "/users/" + userid
+
+	written := false
+	for attempt := 1; attempt <= allocAttempts; attempt++ {
+		//Get Next Available UID
+		uid, err = d.GetUnusedUID()
+		if err != nil {
+			return 0, err
+		}
+		if !reserve(reservedUIDs, uid) {
+			continue
+		}
+
+		//Set UID. Not resent after a 503, another host may have written the user since.
+		debugLog.Println("Query:", userQuery) //DEBUG
+		err = d.client.Patch(userQuery, attrs.UserUIDPatch(uid), false)
+		if err != nil {
+			errorLog.Println("MSGraph request failed:", err)
+			return 0, err
+		}
+		written = true
+
+		current, won, err := claim(userid, uid, time.Now(), func() (uint, bool, error) {
+			var user graph.User
+			if err := d.client.Get(userQuery+"?$select=id,"+attrs.UserSelect(), &user); err != nil {
+				errorLog.Println("MSGraph request failed:", err)
+				return 0, false, err
+			}
+			return attrs.UserUID(user)
+		}, d.uidOwners)
+		if err != nil {
+			return 0, err
+		}
+		if won {
+			if current != uid {
+				debugLog.Println("UID for", userid, "was set by another host:", current)
+			}
+			return current, nil
+		}
+		errorLog.Println("UID", uid, "was also given to another user, retrying for", userid)
+	}
+	//Do not leave the user holding a UID another user owns
+	if written {
+		if err := d.client.Patch(userQuery, attrs.UserUIDClear(), false); err != nil {
+			errorLog.Println("Unable to clear UID of", userid, err)
+		}
+	}
+	return 0, ErrAllocationConflict
+}
+
+// Object IDs of the users holding uid
+func (d *Directory) uidOwners(uid uint) ([]string, error) {
+	attrs := d.idAttributes()
+	getUserQuery := attrs.UserVersion() + "/users?$count=true&$select=id&$filter=" + attrs.UserUIDFilter(uid)
+	users, err := d.client.GetUsers(getUserQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+	owners := []string{}
+	for _, user := range users {
+		owners = append(owners, user.ID)
+	}
+	return owners, nil
+}
+
+// GetUnusedGID looks up existing GIDs and generates a unique GID
+func (d *Directory) GetUnusedGID() (output uint, err error) {
+	gidList, err := d.usedGIDs()
+	if err != nil {
+		return 0, err
+	}
+	//With private groups every UID is also a GID
+	if d.config.UserPrivateGroups {
+		uidList, err := d.usedUIDs()
+		if err != nil {
+			return 0, err
+		}
+		gidList = append(gidList, uidList...)
+	}
+	//Never hand out a GID used by a local group on this host
+	gidList = append(gidList, localIDs(localGroupFile)...)
+
+	reservedRanges, err := parseRanges(d.config.ReservedGIDRanges)
+	if err != nil {
+		return 0, err
+	}
+	newGID, err := d.allocateID(withReserved(gidList, reservedGIDs), reservedRanges, d.config.MinGID, d.config.MaxGID)
+	if err != nil {
+		return 0, err
+	}
+	return uint(newGID), nil
+}
+
+// AutoSetGID allocates an unused GID and writes it to the group in Azure AD,
+// checking it in the same way as AutoSetUID. A group that loses every attempt
+// is left without a GID.
+func (d *Directory) AutoSetGID(groupid string) (gid uint, err error) {
+	attrs := d.idAttributes()
+	groupQuery := "v1.0/groups/" + groupid
+
+	written := false
+	for attempt := 1; attempt <= allocAttempts; attempt++ {
+		//Get Next Available GID
+		gid, err = d.GetUnusedGID()
+		if err != nil {
+			return 0, err
+		}
+		if !reserve(reservedGIDs, gid) {
+			continue
+		}
+
+		//Set GID. Not resent after a 503, another host may have written the group since.
+		debugLog.Println("AutoSetGID Query:", groupQuery) //DEBUG
+		err = d.client.Patch(groupQuery, attrs.GroupGIDPatch(gid), false)
+		if err != nil {
+			errorLog.Println("MSGraph request failed:", err)
+			return 0, err
+		}
+		written = true
+
+		current, won, err := claim(groupid, gid, time.Now(), func() (uint, bool, error) {
+			var group graph.Group
+			if err := d.client.Get(groupQuery+"?$select=id,"+d.config.GroupGidAttribute, &group); err != nil {
+				errorLog.Println("MSGraph request failed:", err)
+				return 0, false, err
+			}
+			return attrs.GroupGID(group)
+		}, d.gidOwners)
+		if err != nil {
+			return 0, err
+		}
+		if won {
+			debugLog.Println("Set GID for: ", current)
+			return current, nil
+		}
+		errorLog.Println("GID", gid, "was also given to another group, retrying for", groupid)
+	}
+	//Do not leave the group holding a GID another group owns
+	if written {
+		if err := d.client.Patch(groupQuery, attrs.GroupGIDClear(), false); err != nil {
+			errorLog.Println("Unable to clear GID of", groupid, err)
+		}
+	}
+	return 0, ErrAllocationConflict
+}
+
+// Object IDs of the groups holding gid
+func (d *Directory) gidOwners(gid uint) ([]string, error) {
+	getGroupQuery := "v1.0/groups?$count=true&$select=id&$filter=" + d.idAttributes().GroupGIDFilter(gid)
+	groups, err := d.client.GetGroups(getGroupQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+	owners := []string{}
+	for _, group := range groups {
+		owners = append(owners, group.ID)
+	}
+	return owners, nil
+}
@@ -0,0 +1,348 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// newTestDirectory returns a writable Directory querying handler in place of
+// Microsoft Graph. Local files are empty and allocation waits are short.
+func newTestDirectory(t *testing.T, config *conf.Config, handler http.Handler) *Directory {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	passwdFile, groupFile := localPasswdFile, localGroupFile
+	settleTime, pollTime, verifyTime := allocSettle, allocPoll, allocVerify
+	localPasswdFile, localGroupFile = empty, empty
+	allocSettle, allocPoll, allocVerify = 50*time.Millisecond, 5*time.Millisecond, 2*fakeLag
+	reservedUIDs, reservedGIDs = map[uint]bool{}, map[uint]bool{}
+	usersIndex, groupsList = nil, nil
+	t.Cleanup(func() {
+		localPasswdFile, localGroupFile = passwdFile, groupFile
+		allocSettle, allocPoll, allocVerify = settleTime, pollTime, verifyTime
+	})
+
+	return &Directory{
+		config:   config,
+		client:   &graph.Client{BaseURL: srv.URL, HTTPClient: srv.Client()},
+		writable: true,
+	}
+}
+
+// How long the fake Graph takes to show a write in filtered queries, like the
+// Azure AD index behind ConsistencyLevel eventual catching up
+const fakeLag = 20 * time.Millisecond
+
+// fakeIDs stands in for Graph holding the UID or GID attribute of users or
+// groups, the only fields ID allocation reads and writes. Reading an object
+// shows every write to it, collection queries only those older than their lag.
+type fakeIDs struct {
+	//"users" or "groups"
+	kind      string
+	attribute string
+
+	mu sync.Mutex
+	//Writes to each object in the order made
+	writes map[string][]fakeWrite
+	//PATCH requests made
+	patches int
+	//Called after each PATCH with the ID written, nil when cleared. Stands
+	//in for other hosts writing at the same moment.
+	onPatch func(f *fakeIDs, id string, value *uint)
+}
+
+// fakeWrite is an ID written to an object, nil when cleared
+type fakeWrite struct {
+	value   *uint
+	visible time.Time
+}
+
+func newFakeIDs(kind string, attribute string) *fakeIDs {
+	return &fakeIDs{kind: kind, attribute: attribute, writes: map[string][]fakeWrite{}}
+}
+
+// set writes the ID of object id, showing in queries after lag
+func (f *fakeIDs) set(id string, value uint, lag time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.write(id, &value, lag)
+}
+
+func (f *fakeIDs) write(id string, value *uint, lag time.Duration) {
+	f.writes[id] = append(f.writes[id], fakeWrite{value, time.Now().Add(lag)})
+}
+
+// get returns the ID of object id as reading the object shows it
+func (f *fakeIDs) get(id string) (uint, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.latest(id)
+}
+
+func (f *fakeIDs) latest(id string) (uint, bool) {
+	writes := f.writes[id]
+	if len(writes) == 0 || writes[len(writes)-1].value == nil {
+		return 0, false
+	}
+	return *writes[len(writes)-1].value, true
+}
+
+// visible returns the ID of object id as collection queries show it now
+func (f *fakeIDs) visible(id string) (uint, bool) {
+	now := time.Now()
+	writes := f.writes[id]
+	for i := len(writes) - 1; i >= 0; i-- {
+		if !writes[i].visible.After(now) {
+			if writes[i].value == nil {
+				return 0, false
+			}
+			return *writes[i].value, true
+		}
+	}
+	return 0, false
+}
+
+// object encodes an object holding value as Graph returns it
+func (f *fakeIDs) object(id string, value uint, ok bool) map[string]interface{} {
+	o := map[string]interface{}{"id": id}
+	if ok {
+		o[f.attribute] = value
+	}
+	return o
+}
+
+func (f *fakeIDs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	collection := "/v1.0/" + f.kind
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == collection:
+		//Every object, or those holding one ID
+		var wanted *uint
+		if filter := r.URL.Query().Get("$filter"); filter != "" {
+			var value uint
+			if _, err := fmt.Sscanf(filter, f.attribute+" eq %d", &value); err != nil {
+				http.Error(w, "unsupported filter "+filter, http.StatusBadRequest)
+				return
+			}
+			wanted = &value
+		}
+		f.mu.Lock()
+		objects := []map[string]interface{}{}
+		for id := range f.writes {
+			value, ok := f.visible(id)
+			if ok && (wanted == nil || *wanted == value) {
+				objects = append(objects, f.object(id, value, ok))
+			}
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": objects})
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, collection+"/"):
+		id := strings.TrimPrefix(r.URL.Path, collection+"/")
+		f.mu.Lock()
+		value, ok := f.latest(id)
+		o := f.object(id, value, ok)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(o)
+
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, collection+"/"):
+		id := strings.TrimPrefix(r.URL.Path, collection+"/")
+		var body map[string]*uint
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, ok := body[f.attribute]
+		if !ok {
+			http.Error(w, "no "+f.attribute+" in PATCH", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.patches++
+		f.write(id, value, fakeLag)
+		f.mu.Unlock()
+		if f.onPatch != nil {
+			f.onPatch(f, id, value)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusNotFound)
+	}
+}
+
+// Allocation config using the lowest free ID, so candidates are predictable
+func allocConfig() *conf.Config {
+	return &conf.Config{
+		UserUIDAttribute:  "uidNumber",
+		GroupGidAttribute: "gidNumber",
+		UserAutoUID:       true,
+		GroupAutoGID:      true,
+		IDAllocation:      AllocLowestFree,
+		MinUID:            50000,
+		MaxUID:            50100,
+		MinGID:            50000,
+		MaxGID:            50100,
+	}
+}
+
+// allocator runs AutoSetUID or AutoSetGID against fake
+type allocator struct {
+	name     string
+	fake     func() *fakeIDs
+	allocate func(d *Directory, id string) (uint, error)
+}
+
+var allocators = []allocator{
+	{"uid", func() *fakeIDs { return newFakeIDs("users", "uidNumber") }, (*Directory).AutoSetUID},
+	{"gid", func() *fakeIDs { return newFakeIDs("groups", "gidNumber") }, (*Directory).AutoSetGID},
+}
+
+func TestAutoSetID(t *testing.T) {
+	for _, a := range allocators {
+		t.Run(a.name, func(t *testing.T) {
+			fake := a.fake()
+			fake.set("other", 50000, 0)
+			d := newTestDirectory(t, allocConfig(), fake)
+
+			id, err := a.allocate(d, "mine")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != 50001 {
+				t.Errorf("allocated %d, want the lowest free ID 50001", id)
+			}
+			if stored, _ := fake.get("mine"); stored != id {
+				t.Errorf("stored %d, want %d", stored, id)
+			}
+			if fake.patches != 1 {
+				t.Errorf("made %d PATCH requests, want 1", fake.patches)
+			}
+		})
+	}
+}
+
+// Another host gives a different object the same ID. Its write only shows in
+// the query for owners of the ID after fakeLag, once allocVerify has passed.
+// Only this host's side is run, the other host's write is made by onPatch or
+// before the allocation and is never retried.
+func TestAutoSetIDRace(t *testing.T) {
+	tests := []struct {
+		name  string
+		other string
+		//Whether the other host writes at the same moment as this one, or
+		//just before this host looks for used IDs
+		before bool
+	}{
+		{"same moment, lower object ID", "aaaa", false},
+		{"same moment, higher object ID", "zzzz", false},
+		{"earlier write not yet shown", "aaaa", true},
+	}
+	for _, a := range allocators {
+		for _, tt := range tests {
+			t.Run(a.name+"/"+tt.name, func(t *testing.T) {
+				fake := a.fake()
+				if tt.before {
+					fake.set(tt.other, 50000, fakeLag)
+				} else {
+					fake.onPatch = func(f *fakeIDs, id string, value *uint) {
+						//The other host only races for the first ID
+						if _, taken := f.get(tt.other); id == "mine" && value != nil && !taken {
+							f.set(tt.other, *value, fakeLag)
+						}
+					}
+				}
+				d := newTestDirectory(t, allocConfig(), fake)
+
+				id, err := a.allocate(d, "mine")
+				if err != nil {
+					t.Fatal(err)
+				}
+				other, _ := fake.get(tt.other)
+				if id == other {
+					t.Errorf("mine and %s both hold %d", tt.other, id)
+				}
+				if id != 50001 {
+					t.Errorf("allocated %d, want 50001 after losing 50000", id)
+				}
+				if stored, _ := fake.get("mine"); stored != id {
+					t.Errorf("stored %d, want %d", stored, id)
+				}
+				if fake.patches != 2 {
+					t.Errorf("made %d PATCH requests, want 2", fake.patches)
+				}
+			})
+		}
+	}
+}
+
+// Another host gave the same object an ID at the same moment and its write
+// landed last, the read-back returns its ID and that ID is used
+func TestAutoSetIDReadBack(t *testing.T) {
+	for _, a := range allocators {
+		t.Run(a.name, func(t *testing.T) {
+			fake := a.fake()
+			fake.onPatch = func(f *fakeIDs, id string, value *uint) {
+				f.set(id, 50050, fakeLag)
+			}
+			d := newTestDirectory(t, allocConfig(), fake)
+
+			id, err := a.allocate(d, "mine")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != 50050 {
+				t.Errorf("allocated %d, want the other host's 50050", id)
+			}
+			if fake.patches != 1 {
+				t.Errorf("made %d PATCH requests, want 1", fake.patches)
+			}
+		})
+	}
+}
+
+// Every candidate is given to another object at the same moment. The
+// allocation fails and the object is not left holding another object's ID.
+func TestAutoSetIDConflict(t *testing.T) {
+	for _, a := range allocators {
+		t.Run(a.name, func(t *testing.T) {
+			fake := a.fake()
+			others := 0
+			fake.onPatch = func(f *fakeIDs, id string, value *uint) {
+				if id == "mine" && value != nil {
+					others++
+					f.set(fmt.Sprintf("other%d", others), *value, fakeLag)
+				}
+			}
+			d := newTestDirectory(t, allocConfig(), fake)
+
+			_, err := a.allocate(d, "mine")
+			if !errors.Is(err, ErrAllocationConflict) {
+				t.Fatalf("got error %v, want ErrAllocationConflict", err)
+			}
+			if stored, ok := fake.get("mine"); ok {
+				t.Errorf("left holding %d, want the ID cleared", stored)
+			}
+			//One write per attempt, then the clear
+			if fake.patches != allocAttempts+1 {
+				t.Errorf("made %d PATCH requests, want %d", fake.patches, allocAttempts+1)
+			}
+		})
+	}
+}
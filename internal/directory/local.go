@@ -0,0 +1,197 @@
+package directory
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// Local files databases. These are read directly, going through NSS would end up back here.
+var (
+	localPasswdFile = "/etc/passwd"
+	localGroupFile  = "/etc/group"
+)
+
+// idRange is an inclusive range of IDs
+type idRange struct {
+	min int
+	max int
+}
+
+// parseRanges parses reserved ranges written as "1000-1999" or a single "5000"
+func parseRanges(ranges []string) ([]idRange, error) {
+	result := []idRange{}
+	for _, r := range ranges {
+		parts := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved ID range %q", r)
+		}
+		max := min
+		if len(parts) == 2 {
+			if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+				return nil, fmt.Errorf("invalid reserved ID range %q", r)
+			}
+		}
+		if max < min {
+			return nil, fmt.Errorf("invalid reserved ID range %q", r)
+		}
+		result = append(result, idRange{min, max})
+	}
+	return result, nil
+}
+
+// mergeRanges clips ranges to min-max and returns them sorted with overlaps joined
+func mergeRanges(ranges []idRange, min int, max int) []idRange {
+	clipped := []idRange{}
+	for _, r := range ranges {
+		if r.min < min {
+			r.min = min
+		}
+		if r.max > max {
+			r.max = max
+		}
+		if r.min <= r.max {
+			clipped = append(clipped, r)
+		}
+	}
+	sort.Slice(clipped, func(i, j int) bool { return clipped[i].min < clipped[j].min })
+
+	merged := []idRange{}
+	for _, r := range clipped {
+		last := len(merged) - 1
+		if last >= 0 && r.min <= merged[last].max+1 {
+			if r.max > merged[last].max {
+				merged[last].max = r.max
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// localEntry is a name and ID from /etc/passwd or /etc/group
+type localEntry struct {
+	name string
+	id   int
+}
+
+// readLocal reads the names and IDs from a passwd or group format file
+func readLocal(path string) ([]localEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []localEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		//name:password:id:...
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, localEntry{fields[0], id})
+	}
+	return entries, scanner.Err()
+}
+
+// localIDs returns the IDs used in a local passwd or group file
+func localIDs(path string) []int {
+	entries, err := readLocal(path)
+	if err != nil {
+		errorLog.Println("Unable to read local IDs from", path, err)
+		return nil
+	}
+	ids := []int{}
+	for _, e := range entries {
+		ids = append(ids, e.id)
+	}
+	return ids
+}
+
+// LocalUser reports whether name is an account in this host's /etc/passwd.
+// Local accounts are not in Azure AD, so there is nothing to ask it about them.
+func LocalUser(name string) bool {
+	entries, err := readLocal(localPasswdFile)
+	if err != nil {
+		errorLog.Println("Unable to read local users from", localPasswdFile, err)
+		return false
+	}
+	for _, e := range entries {
+		if e.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Clash is an Azure AD user or group sharing its ID with a local account or group on this host
+type Clash struct {
+	//"uid" or "gid"
+	Kind  string
+	ID    uint
+	Azure string
+	Local string
+}
+
+func (c Clash) String() string {
+	return fmt.Sprintf("%s %d: AzureAD %s clashes with local %s", c.Kind, c.ID, c.Azure, c.Local)
+}
+
+// LocalClashes lists the entries in passwd and group whose ID is also used in
+// this host's /etc/passwd or /etc/group
+func LocalClashes(passwd []nssStructs.Passwd, group []nssStructs.Group) ([]Clash, error) {
+	clashes := []Clash{}
+
+	users, err := readLocal(localPasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	localUsers := map[int][]string{}
+	for _, u := range users {
+		localUsers[u.id] = append(localUsers[u.id], u.name)
+	}
+	for _, p := range passwd {
+		if p.UID == NobodyID {
+			continue
+		}
+		for _, name := range localUsers[int(p.UID)] {
+			clashes = append(clashes, Clash{Kind: "uid", ID: p.UID, Azure: p.Username, Local: name})
+		}
+	}
+
+	groups, err := readLocal(localGroupFile)
+	if err != nil {
+		return nil, err
+	}
+	localGroups := map[int][]string{}
+	for _, g := range groups {
+		localGroups[g.id] = append(localGroups[g.id], g.name)
+	}
+	for _, g := range group {
+		for _, name := range localGroups[int(g.GID)] {
+			//Groups from group-mappings share the local group's name and GID on purpose
+			if name == g.Groupname {
+				continue
+			}
+			clashes = append(clashes, Clash{Kind: "gid", ID: g.GID, Azure: g.Groupname, Local: name})
+		}
+	}
+	return clashes, nil
+}
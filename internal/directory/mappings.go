@@ -0,0 +1,154 @@
+package directory
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/datty/pam-azuread/internal/graph"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// Azure AD groups mapped onto local groups with group-mappings are returned
+// under the local group's name and GID, so glibc's [SUCCESS=merge] adds their
+// members to the group from /etc/group. Azure AD groups mapped to the same
+// local group are returned as a single group.
+
+// localGroupGID returns the GID of a group in /etc/group, read on first use.
+// Mappings to groups missing from it are ignored.
+func (d *Directory) localGroupGID(name string) (uint, bool) {
+	d.localGroupsOnce.Do(func() {
+		entries, err := readLocal(localGroupFile)
+		if err != nil {
+			errorLog.Println("Unable to read", localGroupFile, err)
+			return
+		}
+		d.localGroups = map[string]uint{}
+		for _, e := range entries {
+			//The first entry wins, as it does for the files service
+			if _, ok := d.localGroups[e.name]; !ok {
+				d.localGroups[e.name] = uint(e.id)
+			}
+		}
+		for id, local := range d.config.GroupMappings {
+			if _, ok := d.localGroups[local]; !ok {
+				warnLog.Println("Ignoring group mapping of", id, "no group", local, "in", localGroupFile)
+			}
+		}
+	})
+	gid, ok := d.localGroups[name]
+	return gid, ok
+}
+
+// mappedGroup returns the local group an Azure AD group is mapped to, ok is
+// false when it is not mapped or the local group does not exist
+func (d *Directory) mappedGroup(id string) (name string, gid uint, ok bool) {
+	name, mapped := d.config.GroupMappings[id]
+	if !mapped {
+		return "", 0, false
+	}
+	gid, ok = d.localGroupGID(name)
+	return name, gid, ok
+}
+
+// mappedIDs returns the IDs of the Azure AD groups mapped to local group
+// name, sorted so entries are stable
+func (d *Directory) mappedIDs(name string) []string {
+	ids := []string{}
+	for id, local := range d.config.GroupMappings {
+		if local == name {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ids
+	}
+	if _, ok := d.localGroupGID(name); !ok {
+		return []string{}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// mappedName returns the local group with gid that Azure AD groups are mapped to
+func (d *Directory) mappedName(gid uint) (string, bool) {
+	for _, name := range d.config.GroupMappings {
+		if local, ok := d.localGroupGID(name); ok && local == gid {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// isMappedName reports whether Azure AD groups are mapped to local group name.
+// Such names belong to the mapped groups, never to a group of that name.
+func (d *Directory) isMappedName(name string) bool {
+	return len(d.mappedIDs(name)) != 0
+}
+
+// mappedGroupByName returns local group name with the members of the visible
+// Azure AD groups mapped to it, fetched in a single request
+func (d *Directory) mappedGroupByName(name string) (nssStructs.Group, error) {
+	ids := d.mappedIDs(name)
+	if len(ids) == 0 {
+		return nssStructs.Group{}, ErrNotFound
+	}
+	quoted := []string{}
+	for _, id := range ids {
+		quoted = append(quoted, odataString(id))
+	}
+	getGroupQuery := "v1.0/groups?$count=true&" + membersExpand + "&$select=" + d.groupSelect() + filterParam("id+in+("+strings.Join(quoted, ",")+")", d.groupFilter())
+	debugLog.Println("Mapped Group Query:", name) //DEBUG
+	groups, err := d.client.GetGroups(getGroupQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nssStructs.Group{}, err
+	}
+
+	visible := []graph.Group{}
+	for _, group := range groups {
+		inScope, err := d.groupInScope(group.ID)
+		if err != nil {
+			return nssStructs.Group{}, err
+		}
+		if !inScope {
+			continue
+		}
+		if err := d.resolveMembers(&group); err != nil {
+			return nssStructs.Group{}, err
+		}
+		visible = append(visible, group)
+	}
+	entries := d.groupEntries(visible, nil)
+	if len(entries) == 0 {
+		return nssStructs.Group{}, ErrNotFound
+	}
+	return entries[0], nil
+}
+
+// mergeMappedGroups combines the entries of Azure AD groups mapped to the same
+// local group. Group names are unique by now, so entries sharing a name are
+// mapped ones.
+func mergeMappedGroups(entries []nssStructs.Group) []nssStructs.Group {
+	result := []nssStructs.Group{}
+	index := map[string]int{}
+	for _, e := range entries {
+		i, seen := index[e.Groupname]
+		if !seen {
+			index[e.Groupname] = len(result)
+			result = append(result, e)
+			continue
+		}
+		members := map[string]bool{}
+		for _, m := range result[i].Members {
+			members[m] = true
+		}
+		for _, m := range e.Members {
+			if !members[m] {
+				members[m] = true
+				result[i].Members = append(result[i].Members, m)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,307 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/graph"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// How login names are built from Azure AD users
+const (
+	//The UPN without its domain, the default
+	MappingShort = "short"
+	//The UPN without its domain for users in the o365-domain domain, the full UPN otherwise
+	MappingStripPrimaryDomain = "strip-primary-domain"
+	//The full UPN
+	MappingUPN = "upn"
+	//mailNickname, users without one fall back to short
+	MappingMailNickname = "mailNickname"
+	//The pre-Windows 2000 name synced from on-premises AD, cloud only users fall back to short
+	MappingSamAccountName = "onPremisesSamAccountName"
+	//The UPN with "@" replaced by ".", alice@example.org is alice.example.org
+	MappingUserDomain = "user.domain"
+)
+
+// B2B guests have UPNs like alice_gmail.com#EXT#@tenant.onmicrosoft.com
+const guestMarker = "#EXT#"
+
+// The configured username mapping. username-attribute is the older way of
+// choosing onPremisesSamAccountName.
+func usernameMapping(config *conf.Config) string {
+	if config.UsernameMapping != "" {
+		return config.UsernameMapping
+	}
+	if config.UsernameAttribute == MappingSamAccountName {
+		return MappingSamAccountName
+	}
+	return MappingShort
+}
+
+// Split a UPN into its local part and domain
+func splitUPN(upn string) (local string, domain string) {
+	i := strings.LastIndex(upn, "@")
+	if i < 0 {
+		return upn, ""
+	}
+	return upn[:i], upn[i+1:]
+}
+
+// Domain of o365-domain, "%s@example.org" is example.org
+func primaryDomain(config *conf.Config) string {
+	_, domain := splitUPN(config.Domain)
+	return domain
+}
+
+// Domains whose users can be found by name, o365-domain first then username-domains
+func lookupDomains(config *conf.Config) []string {
+	domains := []string{}
+	if primary := primaryDomain(config); primary != "" {
+		domains = append(domains, primary)
+	}
+	for _, domain := range config.UsernameDomains {
+		if !strings.EqualFold(domain, primaryDomain(config)) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// Whether users from domain are allowed, all domains are when username-domains is empty
+func allowedDomain(config *conf.Config, domain string) bool {
+	if len(config.UsernameDomains) == 0 {
+		return true
+	}
+	for _, allowed := range config.UsernameDomains {
+		if strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapUsername returns the login name of a user, ok is false when the user has
+// no login name: their domain is not allowed, or they are a guest and guests
+// are not included
+func mapUsername(config *conf.Config, upn string, samAccountName string, mailNickname string) (name string, ok bool) {
+	local, domain := splitUPN(upn)
+	if local == "" {
+		return "", false
+	}
+
+	if i := strings.Index(local, guestMarker); i >= 0 {
+		//Guests are named after their own address, whatever the mapping
+		if !config.UsernameGuests {
+			return "", false
+		}
+		name = local[:i]
+	} else {
+		if !allowedDomain(config, domain) {
+			return "", false
+		}
+		switch usernameMapping(config) {
+		case MappingStripPrimaryDomain:
+			if !strings.EqualFold(domain, primaryDomain(config)) {
+				name = upn
+			}
+		case MappingUPN:
+			name = upn
+		case MappingMailNickname:
+			name = mailNickname
+		case MappingSamAccountName:
+			name = samAccountName
+		case MappingUserDomain:
+			name = local + "." + domain
+		}
+		if name == "" {
+			name = local
+		}
+	}
+
+	if config.UsernameLowercase {
+		name = strings.ToLower(name)
+	}
+	return name, true
+}
+
+// candidateUPNs returns the UPNs a login name could belong to, in the order
+// they are tried
+func candidateUPNs(config *conf.Config, name string) []string {
+	upns := []string{}
+	switch usernameMapping(config) {
+	case MappingUPN:
+		if strings.Contains(name, "@") {
+			upns = append(upns, name)
+		}
+		return upns
+	case MappingStripPrimaryDomain:
+		if strings.Contains(name, "@") {
+			return append(upns, name)
+		}
+		return append(upns, fmt.Sprintf(config.Domain, name))
+	case MappingUserDomain:
+		for _, domain := range lookupDomains(config) {
+			suffix := "." + strings.ToLower(domain)
+			if strings.HasSuffix(strings.ToLower(name), suffix) && len(name) > len(suffix) {
+				upns = append(upns, name[:len(name)-len(suffix)]+"@"+domain)
+			}
+		}
+		return upns
+	}
+	//Short names, and users without the mapped attribute
+	if strings.Contains(name, "@") {
+		return upns
+	}
+	if config.Domain != "" {
+		upns = append(upns, fmt.Sprintf(config.Domain, name))
+	}
+	for _, domain := range config.UsernameDomains {
+		if !strings.EqualFold(domain, primaryDomain(config)) {
+			upns = append(upns, name+"@"+domain)
+		}
+	}
+	return upns
+}
+
+// UPN returns the UPN to sign name in with when it can be worked out without
+// a directory lookup. ok is false when name has to be looked up, see
+// UserPrincipalName, or cannot belong to any user.
+func UPN(config *conf.Config, name string) (upn string, ok bool) {
+	switch usernameMapping(config) {
+	case MappingMailNickname, MappingSamAccountName:
+		return "", false
+	}
+	if config.UsernameGuests {
+		return "", false
+	}
+	upns := candidateUPNs(config, name)
+	if len(upns) != 1 {
+		return "", false
+	}
+	if mapped, ok := mapUsername(config, upns[0], "", ""); !ok || mapped != name {
+		return "", false
+	}
+	return upns[0], true
+}
+
+// UserPrincipalName looks up the UPN of the user with login name name
+func (d *Directory) UserPrincipalName(name string) (string, error) {
+	var user graph.User
+	if err := d.getUserByName(name, "id,userPrincipalName,onPremisesSamAccountName,mailNickname", &user); err != nil {
+		return "", err
+	}
+	return user.UserPrincipalName, nil
+}
+
+// Login name of a user, ok is false when the user has none
+func (d *Directory) username(u graph.User) (string, bool) {
+	return mapUsername(d.config, u.UserPrincipalName, u.OnPremisesSamAccountName, u.MailNickname)
+}
+
+// Get a single user by login name, selecting fields. Names shared by more
+// than one user are not found, in the same way they are left out of enumerations.
+func (d *Directory) getUserByName(name string, fields string, user *graph.User) error {
+	version := d.idAttributes().UserVersion()
+	found := []graph.User{}
+	seen := map[string]bool{}
+	matches := func(users ...graph.User) {
+		for _, u := range users {
+			if mapped, ok := d.username(u); ok && mapped == name && !seen[u.ID] {
+				seen[u.ID] = true
+				found = append(found, u)
+			}
+		}
+	}
+
+	//Every place the name could come from is checked so a shared name is never
+	//resolved to whichever user happens to be found first
+	switch attribute := usernameMapping(d.config); attribute {
+	case MappingMailNickname, MappingSamAccountName:
+		getUserQuery := version + "/users?$count=true&$select=" + fields + "&$filter=" + attribute + "+eq+" + odataString(name)
+		users, err := d.client.GetUsers(getUserQuery)
+		if err != nil {
+			return err
+		}
+		matches(users...)
+	}
+
+	for _, upn := range candidateUPNs(d.config, name) {
+		var u graph.User
+		err := d.client.Get(version+"/users/"+url.PathEscape(upn)+"?$select="+fields, &u)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		matches(u)
+	}
+
+	if d.config.UsernameGuests && !strings.Contains(name, "@") {
+		getUserQuery := version + "/users?$count=true&$select=" + fields + "&$filter=startswith(userPrincipalName," + odataString(name+guestMarker+"@") + ")"
+		users, err := d.client.GetUsers(getUserQuery)
+		if err != nil {
+			return err
+		}
+		matches(users...)
+	}
+
+	switch len(found) {
+	case 0:
+		return ErrNotFound
+	case 1:
+		*user = found[0]
+		return nil
+	}
+	errorLog.Printf("Username %s is shared by %d users, skipping", name, len(found))
+	return fmt.Errorf("%w: username %s is shared by %d users", ErrNotFound, name, len(found))
+}
+
+// sharedNames counts the names used more than once
+func sharedNames(names []string) map[string]int {
+	count := map[string]int{}
+	for _, name := range names {
+		count[name]++
+	}
+	for name, n := range count {
+		if n < 2 {
+			delete(count, name)
+		}
+	}
+	return count
+}
+
+// dropSharedUsernames removes users that share a username. Which of them
+// should get the name cannot be decided, so none do.
+func dropSharedUsernames(entries []nssStructs.Passwd) []nssStructs.Passwd {
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Username)
+	}
+	shared := sharedNames(names)
+	if len(shared) == 0 {
+		return entries
+	}
+	result := []nssStructs.Passwd{}
+	for _, e := range entries {
+		if n := shared[e.Username]; n > 0 {
+			errorLog.Printf("Username %s is shared by %d users, skipping. Change username-mapping or username-domains to resolve", e.Username, n)
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// errNoUsername is returned for users left out by the username mapping
+var errNoUsername = fmt.Errorf("%w: no username for user", ErrNotFound)
+
+// isNoUsername reports whether err means a user was left out by the username mapping
+func isNoUsername(err error) bool {
+	return errors.Is(err, errNoUsername)
+}
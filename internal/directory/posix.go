@@ -0,0 +1,125 @@
+package directory
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// Defaults for home-dir, default-shell and fallback-shell
+const (
+	defaultHomeDir       = "/home/%u"
+	defaultShell         = "/bin/bash"
+	defaultFallbackShell = "/bin/sh"
+)
+
+// List of valid login shells
+var shellsFile = "/etc/shells"
+
+// homeDir returns the home directory of a user. A user's home attribute wins,
+// otherwise home-dir is expanded:
+//
+//	%u username
+//	%d domain of the UPN
+//	%f full UPN
+//	%l first letter of the username
+//	%o object ID
+//	%% a literal %
+func (d *Directory) homeDir(u graph.User, username string) string {
+	if home, ok := d.idAttributes().UserString(u, d.config.UserHomeAttribute); ok {
+		if filepath.IsAbs(home) {
+			return filepath.Clean(home)
+		}
+		errorLog.Println("Ignoring relative home directory for", username, home)
+	}
+
+	template := d.config.HomeDir
+	if template == "" {
+		template = defaultHomeDir
+	}
+	domain := ""
+	if i := strings.LastIndex(u.UserPrincipalName, "@"); i >= 0 {
+		domain = u.UserPrincipalName[i+1:]
+	}
+	//A whole character, usernames may start with a multibyte one
+	first := ""
+	if r, size := utf8.DecodeRuneInString(username); r != utf8.RuneError {
+		first = username[:size]
+	}
+
+	var home strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i == len(template)-1 {
+			home.WriteByte(template[i])
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'u':
+			home.WriteString(username)
+		case 'd':
+			home.WriteString(domain)
+		case 'f':
+			home.WriteString(u.UserPrincipalName)
+		case 'l':
+			home.WriteString(first)
+		case 'o':
+			home.WriteString(u.ID)
+		case '%':
+			home.WriteByte('%')
+		default:
+			home.WriteByte('%')
+			home.WriteByte(template[i])
+		}
+	}
+	return filepath.Clean(home.String())
+}
+
+// shell returns the login shell of a user, their shell attribute if set,
+// otherwise default-shell. A shell missing from /etc/shells is replaced with
+// fallback-shell.
+func (d *Directory) shell(u graph.User) string {
+	shell, ok := d.idAttributes().UserString(u, d.config.UserShellAttribute)
+	if !ok {
+		shell = d.config.DefaultShell
+	}
+	if shell == "" {
+		shell = defaultShell
+	}
+	if d.validShell(shell) {
+		return shell
+	}
+
+	fallback := d.config.FallbackShell
+	if fallback == "" {
+		fallback = defaultFallbackShell
+	}
+	debugLog.Println("Shell", shell, "is not in", shellsFile, "using", fallback)
+	return fallback
+}
+
+// validShell reports whether shell is listed in /etc/shells. Every shell is
+// allowed when the file cannot be read.
+func (d *Directory) validShell(shell string) bool {
+	d.shellsOnce.Do(func() {
+		f, err := os.Open(shellsFile)
+		if err != nil {
+			errorLog.Println("Unable to read", shellsFile, err)
+			return
+		}
+		defer f.Close()
+		d.shells = map[string]bool{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				d.shells[line] = true
+			}
+		}
+	})
+	return d.shells == nil || d.shells[shell]
+}
@@ -0,0 +1,34 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+func TestHomeDir(t *testing.T) {
+	u := graph.User{ID: "1111", UserPrincipalName: "alice@example.com"}
+	tests := []struct {
+		template string
+		username string
+		want     string
+	}{
+		{"", "alice", "/home/alice"},
+		{"/home/%d/%u", "alice", "/home/example.com/alice"},
+		{"/home/%f", "alice", "/home/alice@example.com"},
+		{"/home/%l/%u", "alice", "/home/a/alice"},
+		{"/home/%l/%u", "élodie", "/home/é/élodie"},
+		{"/home/%l/%u", "日本", "/home/日/日本"},
+		{"/home/%l/%u", "", "/home"},
+		{"/srv/%o", "alice", "/srv/1111"},
+		{"/home/100%%/%u", "alice", "/home/100%/alice"},
+		{"/home/%x/%u%", "alice", "/home/%x/alice%"},
+	}
+	for _, tt := range tests {
+		d := &Directory{config: &conf.Config{HomeDir: tt.template}}
+		if got := d.homeDir(u, tt.username); got != tt.want {
+			t.Errorf("homeDir(%q, %q) = %q, want %q", tt.template, tt.username, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package directory
+
+import (
+	"net/url"
+
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// Which users and groups are visible. Each of user-filter, user-scope-groups
+// and user-scope-administrative-units narrows the users further: a user must
+// match the filter and be a member of one of the listed groups or
+// administrative units. Groups work the same way.
+
+// Default scopes, licensed users and security groups
+const (
+	licensedFilter = "assignedLicenses/$count+ne+0"
+	securityFilter = "securityEnabled+eq+true"
+	//Added with user-hide-disabled
+	enabledFilter = "accountEnabled+eq+true"
+)
+
+// OData filter for visible users, empty when every user is visible
+func (d *Directory) userFilter() string {
+	filter := licensedFilter
+	if d.config.UserFilter != "" {
+		filter = url.QueryEscape(d.config.UserFilter)
+	} else if d.config.UserIncludeUnlicensed {
+		filter = ""
+	}
+	if d.config.UserHideDisabled {
+		return andFilter(filter, enabledFilter)
+	}
+	return filter
+}
+
+// OData filter for visible groups
+func (d *Directory) groupFilter() string {
+	if d.config.GroupFilter != "" {
+		return url.QueryEscape(d.config.GroupFilter)
+	}
+	return securityFilter
+}
+
+// andFilter joins OData filters, leaving out empty ones
+func andFilter(filters ...string) string {
+	joined := ""
+	for _, f := range filters {
+		if f == "" {
+			continue
+		}
+		if joined != "" {
+			joined += "+and+"
+		}
+		joined += "(" + f + ")"
+	}
+	return joined
+}
+
+// $filter query parameter, empty when there is nothing to filter on
+func filterParam(filters ...string) string {
+	f := andFilter(filters...)
+	if f == "" {
+		return ""
+	}
+	return "&$filter=" + f
+}
+
+// Whether users or groups are limited to members of groups or administrative units
+func (d *Directory) userScoped() bool {
+	return len(d.config.UserScopeGroups) != 0 || len(d.config.UserScopeUnits) != 0
+}
+
+func (d *Directory) groupScoped() bool {
+	return len(d.config.GroupScopeGroups) != 0 || len(d.config.GroupScopeUnits) != 0
+}
+
+// IDs of the objects of type (user or group) that are members of groups,
+// including nested members, or of administrative units
+func (d *Directory) memberIDs(objectType string, groups []string, units []string) (map[string]bool, error) {
+	queries := []string{}
+	for _, id := range groups {
+		queries = append(queries, "v1.0/groups/"+url.PathEscape(id)+"/transitiveMembers/microsoft.graph."+objectType+"?$select=id")
+	}
+	for _, id := range units {
+		queries = append(queries, "v1.0/directory/administrativeUnits/"+url.PathEscape(id)+"/members/microsoft.graph."+objectType+"?$select=id")
+	}
+
+	ids := map[string]bool{}
+	for _, query := range queries {
+		members, err := d.queryIDs(query)
+		if err != nil {
+			return nil, err
+		}
+		for id := range members {
+			ids[id] = true
+		}
+	}
+	return ids, nil
+}
+
+// userScope returns the IDs of the users in user-scope-groups and
+// user-scope-administrative-units, nil when users are not limited to members
+func (d *Directory) userScope() (map[string]bool, error) {
+	if !d.userScoped() {
+		return nil, nil
+	}
+	return d.memberIDs("user", d.config.UserScopeGroups, d.config.UserScopeUnits)
+}
+
+// groupScope returns the IDs of the groups in group-scope-groups, including
+// the listed groups themselves, and group-scope-administrative-units. nil
+// when groups are not limited to members.
+func (d *Directory) groupScope() (map[string]bool, error) {
+	if !d.groupScoped() {
+		return nil, nil
+	}
+	ids, err := d.memberIDs("group", d.config.GroupScopeGroups, d.config.GroupScopeUnits)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range d.config.GroupScopeGroups {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// Users in scope, scope is nil when every user is
+func scopedUsers(users []graph.User, scope map[string]bool) []graph.User {
+	if scope == nil {
+		return users
+	}
+	result := []graph.User{}
+	for _, user := range users {
+		if scope[user.ID] {
+			result = append(result, user)
+		}
+	}
+	return result
+}
+
+// Groups in scope, scope is nil when every group is
+func scopedGroups(groups []graph.Group, scope map[string]bool) []graph.Group {
+	if scope == nil {
+		return groups
+	}
+	result := []graph.Group{}
+	for _, group := range groups {
+		if scope[group.ID] {
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// Whether an object is, directly or through nesting, a member of one of
+// groups or units
+func (d *Directory) memberOf(objectType string, id string, groups []string, units []string) (bool, error) {
+	getMemberOfQuery := "v1.0/" + objectType + "s/" + url.PathEscape(id) + "/transitiveMemberOf?$select=id"
+	debugLog.Println("MemberOf Query:", id) //DEBUG
+	parents, err := d.client.GetGroups(getMemberOfQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return false, err
+	}
+	wanted := map[string]bool{}
+	for _, g := range append(append([]string{}, groups...), units...) {
+		wanted[g] = true
+	}
+	for _, parent := range parents {
+		if wanted[parent.ID] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// userInScope reports whether a single user is visible, the same users
+// PasswdAll returns. u must have been read with d.userSelect().
+func (d *Directory) userInScope(u graph.User) (bool, error) {
+	if d.config.UserHideDisabled && !enabled(u.AccountEnabled) {
+		return false, nil
+	}
+	if d.config.UserFilter != "" {
+		getUserQuery := d.idAttributes().UserVersion() + "/users?$count=true&$select=id" + filterParam("id+eq+"+odataString(u.ID), d.userFilter())
+		debugLog.Println("User Scope Query:", u.ID) //DEBUG
+		users, err := d.client.GetUsers(getUserQuery)
+		if err != nil {
+			errorLog.Println("MSGraph request failed:", err)
+			return false, err
+		}
+		if len(users) == 0 {
+			return false, nil
+		}
+	} else if !d.config.UserIncludeUnlicensed && len(u.AssignedLicenses) == 0 {
+		return false, nil
+	}
+	if !d.userScoped() {
+		return true, nil
+	}
+	return d.memberOf("user", u.ID, d.config.UserScopeGroups, d.config.UserScopeUnits)
+}
+
+// groupInScope reports whether a single group, already known to match the
+// group filter, is visible
+func (d *Directory) groupInScope(id string) (bool, error) {
+	if !d.groupScoped() {
+		return true, nil
+	}
+	for _, g := range d.config.GroupScopeGroups {
+		if g == id {
+			return true, nil
+		}
+	}
+	return d.memberOf("group", id, d.config.GroupScopeGroups, d.config.GroupScopeUnits)
+}
+
+// IDs of the objects returned by query. Only IDs are read, so users and
+// groups decode alike.
+func (d *Directory) queryIDs(query string) (map[string]bool, error) {
+	debugLog.Println("Scope Query:", query) //DEBUG
+	objects, err := d.client.GetGroups(query)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, o := range objects {
+		ids[o.ID] = true
+	}
+	return ids, nil
+}
+
+// intersect returns the IDs in both a and b, nil stands for every ID
+func intersect(a map[string]bool, b map[string]bool) map[string]bool {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	both := map[string]bool{}
+	for id := range a {
+		if b[id] {
+			both[id] = true
+		}
+	}
+	return both
+}
+
+// stateScope returns the IDs of the visible users and groups for a State.
+// The default filters are checked against the state itself, so nil is
+// returned unless user-filter, group-filter or a scope is set.
+func (d *Directory) stateScope() (users map[string]bool, groups map[string]bool, err error) {
+	if d.config.UserFilter != "" {
+		users, err = d.queryIDs(d.idAttributes().UserVersion() + "/users?$count=true&$select=id" + filterParam(d.userFilter()))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	members, err := d.userScope()
+	if err != nil {
+		return nil, nil, err
+	}
+	users = intersect(users, members)
+
+	if d.config.GroupFilter != "" {
+		groups, err = d.queryIDs("v1.0/groups?$count=true&$select=id" + filterParam(d.groupFilter()))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	members, err = d.groupScope()
+	if err != nil {
+		return nil, nil, err
+	}
+	return users, intersect(groups, members), nil
+}
+
+// notInScope is the error for an object found but left out by the scope
+func notInScope(err error) error {
+	if err != nil {
+		return err
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,312 @@
+package directory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/graph"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// State is a local copy of the users and groups in Azure AD, kept up to date
+// with Graph delta queries so only changes are fetched after the first sync.
+type State struct {
+	Users  map[string]graph.User  `json:"users"`
+	Groups map[string]graph.Group `json:"groups"`
+	//Group ID -> member ID -> member @odata.type
+	Members        map[string]map[string]string `json:"members"`
+	UserDeltaLink  string                       `json:"userDeltaLink"`
+	GroupDeltaLink string                       `json:"groupDeltaLink"`
+	Synced         time.Time                    `json:"synced"`
+	//IDs of the visible users and groups when delta queries cannot tell, nil when they can
+	UserScope  map[string]bool `json:"userScope,omitempty"`
+	GroupScope map[string]bool `json:"groupScope,omitempty"`
+}
+
+// NewState returns an empty state, the next Sync will be a full sync
+func NewState() *State {
+	return &State{
+		Users:   map[string]graph.User{},
+		Groups:  map[string]graph.Group{},
+		Members: map[string]map[string]string{},
+	}
+}
+
+// LoadState reads a state saved with Save. A missing file gives an empty state.
+func LoadState(path string) (*State, error) {
+	s := NewState()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Users == nil {
+		s.Users = map[string]graph.User{}
+	}
+	if s.Groups == nil {
+		s.Groups = map[string]graph.Group{}
+	}
+	if s.Members == nil {
+		s.Members = map[string]map[string]string{}
+	}
+	return s, nil
+}
+
+// Save atomically writes the state to path. The state holds delta links that
+// grant access to directory changes, so it is only readable by its owner.
+func (s *State) Save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Sync brings s up to date. The first sync, and any sync where Graph asks for
+// a resync, fetches everything; afterwards only changes are fetched.
+func (d *Directory) Sync(s *State) error {
+	//Delta queries cannot filter, so the scope is fetched alongside
+	userScope, groupScope, err := d.stateScope()
+	if err != nil {
+		return err
+	}
+
+	if s.UserDeltaLink == "" || s.GroupDeltaLink == "" {
+		err = d.fullSync(s)
+	} else {
+		err = d.deltaSync(s)
+		if graph.IsResyncRequired(err) {
+			debugLog.Println("Delta sync expired, running full sync:", err)
+			err = d.fullSync(s)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.UserScope = userScope
+	s.GroupScope = groupScope
+	return nil
+}
+
+// Replace s with a freshly fetched state, s is left untouched on failure
+func (d *Directory) fullSync(s *State) error {
+	fresh := NewState()
+	if err := d.deltaSync(fresh); err != nil {
+		return err
+	}
+	*s = *fresh
+	return nil
+}
+
+// Fetch and apply changes since the delta links in s, or everything if unset.
+// Changes are only applied once both queries have succeeded.
+func (d *Directory) deltaSync(s *State) error {
+	attrs := d.idAttributes()
+
+	userQuery := s.UserDeltaLink
+	if userQuery == "" {
+		userQuery = attrs.UserVersion() + "/users/delta?$select=lastPasswordChangeDateTime," + d.userSelect()
+	}
+	groupQuery := s.GroupDeltaLink
+	if groupQuery == "" {
+		groupQuery = "v1.0/groups/delta?$select=" + d.groupSelect() + ",securityEnabled,members"
+	}
+
+	debugLog.Println("Users Delta Query") //DEBUG
+	users, userLink, err := d.client.DeltaUsers(userQuery)
+	if err != nil {
+		errorLog.Println("Users delta MSGraph request failed:", err)
+		return err
+	}
+	debugLog.Println("Groups Delta Query") //DEBUG
+	groups, groupLink, err := d.client.DeltaGroups(groupQuery)
+	if err != nil {
+		errorLog.Println("Groups delta MSGraph request failed:", err)
+		return err
+	}
+
+	for _, change := range users {
+		if change.Removed != nil {
+			delete(s.Users, change.ID)
+			continue
+		}
+		//New users merge onto an empty user
+		user, err := s.Users[change.ID].Merge(change)
+		if err != nil {
+			return err
+		}
+		s.Users[change.ID] = user
+	}
+
+	for _, change := range groups {
+		if change.Removed != nil {
+			delete(s.Groups, change.ID)
+			delete(s.Members, change.ID)
+			continue
+		}
+		group, err := s.Groups[change.ID].Merge(change)
+		if err != nil {
+			return err
+		}
+		s.Groups[change.ID] = group
+
+		members := s.Members[change.ID]
+		if members == nil {
+			members = map[string]string{}
+			s.Members[change.ID] = members
+		}
+		for _, member := range change.MembersDelta {
+			if member.Removed != nil {
+				delete(members, member.ID)
+			} else {
+				members[member.ID] = member.ODataType
+			}
+		}
+	}
+
+	s.UserDeltaLink = userLink
+	s.GroupDeltaLink = groupLink
+	s.Synced = time.Now()
+	return nil
+}
+
+// Visible users in the state, ordered by ID so entries are stable between syncs
+func (d *Directory) stateUsers(s *State) []graph.User {
+	users := []graph.User{}
+	for _, user := range s.Users {
+		if d.config.UserFilter == "" && !d.config.UserIncludeUnlicensed && len(user.AssignedLicenses) == 0 {
+			continue
+		}
+		if d.config.UserHideDisabled && !enabled(user.AccountEnabled) {
+			continue
+		}
+		if s.UserScope != nil && !s.UserScope[user.ID] {
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// Visible groups in the state with their user members resolved
+func (d *Directory) stateGroups(s *State) []graph.Group {
+	groups := []graph.Group{}
+	for id, group := range s.Groups {
+		if d.config.GroupFilter == "" && !group.SecurityEnabled {
+			continue
+		}
+		if s.GroupScope != nil && !s.GroupScope[id] {
+			continue
+		}
+		group.Members = []graph.Member{}
+		for memberID, odataType := range d.stateMembers(s, id) {
+			member := graph.Member{ODataType: odataType, ID: memberID}
+			if user, ok := s.Users[memberID]; ok {
+				member.UserPrincipalName = user.UserPrincipalName
+				member.OnPremisesSamAccountName = user.OnPremisesSamAccountName
+				member.MailNickname = user.MailNickname
+				member.AccountEnabled = user.AccountEnabled
+			}
+			group.Members = append(group.Members, member)
+		}
+		sort.Slice(group.Members, func(i, j int) bool { return group.Members[i].ID < group.Members[j].ID })
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups
+}
+
+// Type of group members that are groups themselves
+const groupType = "#microsoft.graph.group"
+
+// stateMembers returns the members of a group in s, with the members of
+// nested groups when group-nested-members is set. Each group is expanded once
+// so groups that are members of each other do not loop.
+func (d *Directory) stateMembers(s *State, id string) map[string]string {
+	if !d.config.GroupNestedMembers {
+		return s.Members[id]
+	}
+	members := map[string]string{}
+	expanded := map[string]bool{}
+	var expand func(id string)
+	expand = func(id string) {
+		if expanded[id] {
+			return
+		}
+		expanded[id] = true
+		for memberID, odataType := range s.Members[id] {
+			members[memberID] = odataType
+			if odataType == groupType {
+				expand(memberID)
+			}
+		}
+	}
+	expand(id)
+	return members
+}
+
+// PasswdFromState returns passwd entries for the users in s. UIDs allocated
+// along the way are recorded in s.
+func (d *Directory) PasswdFromState(s *State) []nssStructs.Passwd {
+	attrs := d.idAttributes()
+	passwdResult := d.passwdEntries(d.stateUsers(s), func(user graph.User, uid uint) {
+		if updated, err := attrs.WithUserUID(user, uid); err == nil {
+			s.Users[user.ID] = updated
+		}
+	})
+	if d.config.UserPrivateGroups {
+		gids := map[uint]string{}
+		for _, group := range d.stateGroups(s) {
+			if g, hasGID, err := d.groupToNss(group); err == nil && hasGID {
+				gids[g.GID] = g.Groupname
+			}
+		}
+		d.usePrivateGroups(passwdResult, gids)
+	}
+	return passwdResult
+}
+
+// GroupFromState returns group entries for the groups in s. GIDs allocated
+// along the way are recorded in s. Private groups are not included, see PrivateGroups.
+func (d *Directory) GroupFromState(s *State) []nssStructs.Group {
+	attrs := d.idAttributes()
+	return d.groupEntries(d.stateGroups(s), func(group graph.Group, gid uint) {
+		if updated, err := attrs.WithGroupGID(s.Groups[group.ID], gid); err == nil {
+			s.Groups[group.ID] = updated
+		}
+	})
+}
+
+// ShadowFromState returns shadow entries for the users in s
+func (d *Directory) ShadowFromState(s *State) []nssStructs.Shadow {
+	return d.shadowEntries(d.stateUsers(s))
+}
@@ -0,0 +1,138 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/datty/pam-azuread/internal/conf"
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+const userType = "#microsoft.graph.user"
+
+// cyclicState holds groups a and b that are members of each other and a
+// group self that is a member of itself, each with one user
+func cyclicState() *State {
+	s := NewState()
+	for _, id := range []string{"a", "b", "self"} {
+		s.Groups[id] = graph.Group{ID: id, DisplayName: id, SecurityEnabled: true}
+	}
+	for _, id := range []string{"ua", "ub", "uself"} {
+		s.Users[id] = graph.User{ID: id, UserPrincipalName: id + "@example.com"}
+	}
+	s.Members["a"] = map[string]string{"ua": userType, "b": groupType}
+	s.Members["b"] = map[string]string{"ub": userType, "a": groupType}
+	s.Members["self"] = map[string]string{"uself": userType, "self": groupType}
+	return s
+}
+
+// memberIDs returns the IDs of the members of each group, sorted
+func memberIDs(groups []graph.Group) map[string][]string {
+	result := map[string][]string{}
+	for _, g := range groups {
+		ids := []string{}
+		for _, m := range g.Members {
+			ids = append(ids, m.ID)
+		}
+		sort.Strings(ids)
+		result[g.ID] = ids
+	}
+	return result
+}
+
+func TestStateGroupsCycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		nested bool
+		want   map[string][]string
+		//User member names of each group
+		wantNames map[string][]string
+	}{
+		{"direct members", false, map[string][]string{
+			"a":    {"b", "ua"},
+			"b":    {"a", "ub"},
+			"self": {"self", "uself"},
+		}, map[string][]string{
+			"a":    {"ua@example.com"},
+			"b":    {"ub@example.com"},
+			"self": {"uself@example.com"},
+		}},
+		//Each group counts as a member of itself through the cycle
+		{"nested members", true, map[string][]string{
+			"a":    {"a", "b", "ua", "ub"},
+			"b":    {"a", "b", "ua", "ub"},
+			"self": {"self", "uself"},
+		}, map[string][]string{
+			"a":    {"ua@example.com", "ub@example.com"},
+			"b":    {"ua@example.com", "ub@example.com"},
+			"self": {"uself@example.com"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Directory{config: &conf.Config{GroupNestedMembers: tt.nested, UsernameMapping: MappingUPN}}
+			groups := d.stateGroups(cyclicState())
+			if got := memberIDs(groups); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("members %v, want %v", got, tt.want)
+			}
+
+			names := map[string][]string{}
+			for _, g := range groups {
+				names[g.ID] = d.memberNames(g.Members)
+				sort.Strings(names[g.ID])
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("member names %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+// A group with more members than $expand returns is paged through members
+func TestResolveMembersPaging(t *testing.T) {
+	const total, pageSize = 45, 10
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.0/groups/big/members/microsoft.graph.user" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusNotFound)
+			return
+		}
+		requests++
+		start, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+		members := []graph.Member{}
+		for i := start; i < total && i < start+pageSize; i++ {
+			members = append(members, graph.Member{ODataType: userType, ID: fmt.Sprintf("u%02d", i)})
+		}
+		p := map[string]interface{}{"value": members}
+		if start+pageSize < total {
+			p["@odata.nextLink"] = fmt.Sprintf("http://%s%s?skip=%d", r.Host, r.URL.Path, start+pageSize)
+		}
+		json.NewEncoder(w).Encode(p)
+	})
+	d := newTestDirectory(t, &conf.Config{UsernameMapping: MappingUPN}, handler)
+
+	//$expand stops at membersExpandLimit
+	g := graph.Group{ID: "big"}
+	for i := 0; i < membersExpandLimit; i++ {
+		g.Members = append(g.Members, graph.Member{ODataType: userType, ID: fmt.Sprintf("u%02d", i)})
+	}
+	if err := d.resolveMembers(&g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Members) != total {
+		t.Fatalf("resolved %d members, want %d", len(g.Members), total)
+	}
+	for i, m := range g.Members {
+		if want := fmt.Sprintf("u%02d", i); m.ID != want {
+			t.Errorf("member %d is %s, want %s", i, m.ID, want)
+		}
+	}
+	if want := (total + pageSize - 1) / pageSize; requests != want {
+		t.Errorf("made %d requests, want %d", requests, want)
+	}
+}
@@ -0,0 +1,71 @@
+package directory
+
+import (
+	"errors"
+	"net"
+
+	"github.com/datty/pam-azuread/internal/graph"
+)
+
+// ErrNotFound is returned when the directory has no matching entry
+var ErrNotFound = errors.New("not found")
+
+// Status classifies the outcome of a lookup the way NSS reports it
+type Status int
+
+const (
+	StatusSuccess Status = iota
+	StatusNotFound
+	StatusTryAgain
+	StatusUnavail
+)
+
+// StatusOf maps a failed lookup to the status glibc and nscd should see.
+// Only a definite "not found" is reported as such so outages are never cached
+// as a negative answer.
+func StatusOf(err error) Status {
+	var graphErr *graph.Error
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return StatusSuccess
+	case errors.Is(err, ErrNotFound):
+		return StatusNotFound
+	case errors.Is(err, errTryAgain):
+		return StatusTryAgain
+	case errors.As(err, &graphErr):
+		if graphErr.NotFound() {
+			return StatusNotFound
+		}
+		if graphErr.Temporary() {
+			return StatusTryAgain
+		}
+		return StatusUnavail
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return StatusTryAgain
+	default:
+		return StatusUnavail
+	}
+}
+
+// Err returns the error a status stands for, used where only the status is known
+func (s Status) Err() error {
+	switch s {
+	case StatusSuccess:
+		return nil
+	case StatusNotFound:
+		return ErrNotFound
+	case StatusTryAgain:
+		return errTryAgain
+	default:
+		return errUnavail
+	}
+}
+
+var errTryAgain = errors.New("directory temporarily unavailable")
+var errUnavail = errors.New("directory unavailable")
+
+// IsNotFound reports whether err means the entry does not exist
+func IsNotFound(err error) bool {
+	return StatusOf(err) == StatusNotFound
+}
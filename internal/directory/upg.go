@@ -0,0 +1,159 @@
+package directory
+
+import (
+	"net/url"
+
+	"github.com/datty/pam-azuread/internal/graph"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// User private groups. Each user is given a group of their own, named after
+// them and with GID equal to their UID, as their primary group. The groups
+// only exist here, nothing is created in Azure AD.
+
+// Build the private group of a passwd entry
+func privateGroup(p nssStructs.Passwd) nssStructs.Group {
+	return nssStructs.Group{
+		Groupname: p.Username,
+		Password:  "x",
+		GID:       p.UID,
+		Members:   []string{p.Username},
+	}
+}
+
+// Set the primary GID of a user to their private group. realGroup returns
+// the Azure AD group already using a GID, in which case the user keeps their
+// usual primary GID rather than silently joining that group.
+func (d *Directory) usePrivateGroup(p *nssStructs.Passwd, realGroup func(gid uint) (string, bool)) {
+	if p.UID == NobodyID {
+		return
+	}
+	if name, taken := realGroup(p.UID); taken {
+		errorLog.Printf("Private group for %s conflicts with AzureAD group %s (GID %d), using GID %d", p.Username, name, p.UID, p.GID)
+		return
+	}
+	p.GID = p.UID
+}
+
+// usePrivateGroups sets the primary GID of each user to their private group
+func (d *Directory) usePrivateGroups(passwd []nssStructs.Passwd, realGIDs map[uint]string) {
+	for i := range passwd {
+		d.usePrivateGroup(&passwd[i], func(gid uint) (string, bool) {
+			name, ok := realGIDs[gid]
+			return name, ok
+		})
+	}
+}
+
+// PrivateGroups returns the private groups of the users in passwd. Users whose
+// private group conflicts with an Azure AD group have none.
+func (d *Directory) PrivateGroups(passwd []nssStructs.Passwd) []nssStructs.Group {
+	groups := []nssStructs.Group{}
+	if !d.config.UserPrivateGroups {
+		return groups
+	}
+	for _, p := range passwd {
+		if p.UID != NobodyID && p.GID == p.UID {
+			groups = append(groups, privateGroup(p))
+		}
+	}
+	return groups
+}
+
+// GIDs of all Azure AD groups matching group-filter, with their names
+func (d *Directory) realGIDs() (map[uint]string, error) {
+	getGroupQuery := "v1.0/groups?$count=true&$select=" + d.groupSelect() + filterParam(d.groupFilter())
+	debugLog.Println("Group GIDs Query") //DEBUG
+	groups, err := d.client.GetGroups(getGroupQuery)
+	if err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return nil, err
+	}
+	gids := map[uint]string{}
+	for _, group := range groups {
+		g, hasGID, err := d.groupToNss(group)
+		if err == nil && hasGID {
+			gids[g.GID] = g.Groupname
+		}
+	}
+	return gids, nil
+}
+
+// Name of the Azure AD group matching group-filter using gid
+func (d *Directory) realGroup(gid uint) (string, bool, error) {
+	if d.config.GroupGidAttribute != "" {
+		getGroupQuery := "v1.0/groups?$count=true&$select=" + d.groupNameSelect() + filterParam(d.idAttributes().GroupGIDFilter(gid), d.groupFilter())
+		debugLog.Println("Group GID Query:", gid) //DEBUG
+		groups, err := d.client.GetGroups(getGroupQuery)
+		if err != nil {
+			errorLog.Println("MSGraph request failed:", err)
+			return "", false, err
+		}
+		if len(groups) != 0 {
+			return d.groupName(groups[0]), true, nil
+		}
+	}
+	if !d.hashMapping() {
+		return "", false, nil
+	}
+
+	//Hashed GIDs are not stored in Azure AD so cannot be filtered on
+	gids, err := d.visibleGroupIDs()
+	if err != nil {
+		return "", false, err
+	}
+	id, ok := gids.hashedOwner(gid)
+	if !ok {
+		return "", false, nil
+	}
+	var group graph.Group
+	if err := d.client.Get("v1.0/groups/"+url.PathEscape(id)+"?$select="+d.groupNameSelect(), &group); err != nil {
+		errorLog.Println("MSGraph request failed:", err)
+		return "", false, err
+	}
+	return d.groupName(group), true, nil
+}
+
+// Set the primary GID of a single user to their private group
+func (d *Directory) usePrivateGroupLive(p *nssStructs.Passwd) error {
+	if p.UID == NobodyID {
+		return nil
+	}
+	name, taken, err := d.realGroup(p.UID)
+	if err != nil {
+		return err
+	}
+	d.usePrivateGroup(p, func(uint) (string, bool) { return name, taken })
+	return nil
+}
+
+// Private group named after a user, ErrNotFound unless private groups are enabled
+func (d *Directory) privateGroupByName(name string) (nssStructs.Group, error) {
+	if !d.config.UserPrivateGroups {
+		return nssStructs.Group{}, ErrNotFound
+	}
+	p, err := d.PasswdByName(name)
+	if err != nil {
+		return nssStructs.Group{}, err
+	}
+	if p.UID == NobodyID || p.GID != p.UID {
+		return nssStructs.Group{}, ErrNotFound
+	}
+	return privateGroup(p), nil
+}
+
+// Private group with GID gid, ErrNotFound unless private groups are enabled
+func (d *Directory) privateGroupByGid(gid uint) (nssStructs.Group, error) {
+	if !d.config.UserPrivateGroups {
+		return nssStructs.Group{}, ErrNotFound
+	}
+	p, err := d.PasswdByUid(gid)
+	if err != nil {
+		return nssStructs.Group{}, err
+	}
+	if p.GID != p.UID {
+		return nssStructs.Group{}, ErrNotFound
+	}
+	return privateGroup(p), nil
+}
@@ -0,0 +1,236 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Where user UIDs and GIDs are stored
+const (
+	//Directory extensions, including extensions synced from on-premises AD by Entra Connect
+	SourceExtension = "extension"
+	//Custom security attributes in AttributeSet
+	SourceSecurityAttributes = "security-attributes"
+	//onPremisesExtensionAttributes, named extensionAttribute1 to extensionAttribute15
+	SourceOnPremises = "on-premises"
+)
+
+// IDAttributes describes where POSIX UIDs, GIDs and other user attributes are
+// stored on directory objects. Groups have neither custom security attributes
+// nor onPremisesExtensionAttributes, so group GIDs are always read from a
+// directory extension.
+type IDAttributes struct {
+	//Where user attributes are stored, directory extensions when empty
+	Source       string
+	AttributeSet string
+	UserUIDName  string
+	UserGIDName  string
+	GroupGIDName string
+	//Optional per-user overrides of the home directory and login shell
+	UserHomeName  string
+	UserShellName string
+}
+
+// UserVersion returns the Graph API version user queries must use
+func (a IDAttributes) UserVersion() string {
+	//customSecurityAttributes are only available on the beta endpoint
+	if a.Source == SourceSecurityAttributes {
+		return "beta"
+	}
+	return "v1.0"
+}
+
+// UserSelect returns the $select fields needed to read user IDs
+func (a IDAttributes) UserSelect() string {
+	switch a.Source {
+	case SourceSecurityAttributes:
+		return "customSecurityAttributes"
+	case SourceOnPremises:
+		return "onPremisesExtensionAttributes"
+	}
+	fields := []string{}
+	for _, name := range []string{a.UserUIDName, a.UserGIDName, a.UserHomeName, a.UserShellName} {
+		if name != "" {
+			fields = append(fields, name)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// UserUIDFilter returns an OData filter matching users with the given UID
+func (a IDAttributes) UserUIDFilter(uid uint) string {
+	switch a.Source {
+	case SourceSecurityAttributes:
+		return fmt.Sprintf("customSecurityAttributes/%s/%s+eq+%d", a.AttributeSet, a.UserUIDName, uid)
+	case SourceOnPremises:
+		//onPremisesExtensionAttributes are strings
+		return fmt.Sprintf("onPremisesExtensionAttributes/%s+eq+'%d'", a.UserUIDName, uid)
+	}
+	return fmt.Sprintf("%s+eq+%d", a.UserUIDName, uid)
+}
+
+// GroupGIDFilter returns an OData filter matching groups with the given GID
+func (a IDAttributes) GroupGIDFilter(gid uint) string {
+	return fmt.Sprintf("%s+eq+%d", a.GroupGIDName, gid)
+}
+
+// UserUID reads the UID of a user, ok is false when no UID is set
+func (a IDAttributes) UserUID(u User) (id uint, ok bool, err error) {
+	return parseID(a.userAttribute(u, a.UserUIDName))
+}
+
+// UserGID reads the primary GID of a user, ok is false when no GID is set
+func (a IDAttributes) UserGID(u User) (id uint, ok bool, err error) {
+	if a.UserGIDName == "" {
+		return 0, false, nil
+	}
+	return parseID(a.userAttribute(u, a.UserGIDName))
+}
+
+// UserString reads a string attribute of a user, ok is false when it is not set
+func (a IDAttributes) UserString(u User, name string) (value string, ok bool) {
+	if name == "" {
+		return "", false
+	}
+	raw := a.userAttribute(u, name)
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil || value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+// GroupGID reads the GID of a group, ok is false when no GID is set
+func (a IDAttributes) GroupGID(g Group) (id uint, ok bool, err error) {
+	return parseID(g.Attributes[a.GroupGIDName])
+}
+
+// UserUIDPatch returns the PATCH body setting a user's UID
+func (a IDAttributes) UserUIDPatch(uid uint) interface{} {
+	switch a.Source {
+	case SourceOnPremises:
+		//Only accepted for cloud users, synced users are written by Entra Connect
+		return map[string]interface{}{
+			"onPremisesExtensionAttributes": map[string]interface{}{
+				a.UserUIDName: strconv.FormatUint(uint64(uid), 10),
+			},
+		}
+	case SourceSecurityAttributes:
+		return map[string]interface{}{
+			"customSecurityAttributes": map[string]interface{}{
+				a.AttributeSet: map[string]interface{}{
+					"@odata.type":                 "#microsoft.graph.customSecurityAttributeValue",
+					a.UserUIDName + "@odata.type": "#Int32",
+					a.UserUIDName:                 uid,
+				},
+			},
+		}
+	}
+	return map[string]interface{}{a.UserUIDName: uid}
+}
+
+// UserUIDClear returns the PATCH body removing a user's UID
+func (a IDAttributes) UserUIDClear() interface{} {
+	switch a.Source {
+	case SourceOnPremises:
+		return map[string]interface{}{
+			"onPremisesExtensionAttributes": map[string]interface{}{a.UserUIDName: nil},
+		}
+	case SourceSecurityAttributes:
+		return map[string]interface{}{
+			"customSecurityAttributes": map[string]interface{}{
+				a.AttributeSet: map[string]interface{}{
+					"@odata.type": "#microsoft.graph.customSecurityAttributeValue",
+					a.UserUIDName: nil,
+				},
+			},
+		}
+	}
+	return map[string]interface{}{a.UserUIDName: nil}
+}
+
+// GroupGIDPatch returns the PATCH body setting a group's GID
+func (a IDAttributes) GroupGIDPatch(gid uint) interface{} {
+	return map[string]interface{}{a.GroupGIDName: gid}
+}
+
+// GroupGIDClear returns the PATCH body removing a group's GID
+func (a IDAttributes) GroupGIDClear() interface{} {
+	return map[string]interface{}{a.GroupGIDName: nil}
+}
+
+// WithUserUID returns u with its UID attribute set, used to record a UID written to Azure AD
+func (a IDAttributes) WithUserUID(u User, uid uint) (User, error) {
+	raw := json.RawMessage(strconv.FormatUint(uint64(uid), 10))
+	change := map[string]json.RawMessage{}
+	switch a.Source {
+	case SourceOnPremises:
+		ext := map[string]json.RawMessage{}
+		for k, v := range u.OnPremisesExtensionAttributes {
+			ext[k] = v
+		}
+		ext[a.UserUIDName] = json.RawMessage(strconv.Quote(string(raw)))
+		b, err := json.Marshal(ext)
+		if err != nil {
+			return u, err
+		}
+		change["onPremisesExtensionAttributes"] = b
+	case SourceSecurityAttributes:
+		set := AttributeSet{}
+		for k, v := range u.CustomSecurityAttributes[a.AttributeSet] {
+			set[k] = v
+		}
+		set[a.UserUIDName] = raw
+		csa := CustomSecurityAttributes{}
+		for k, v := range u.CustomSecurityAttributes {
+			csa[k] = v
+		}
+		csa[a.AttributeSet] = set
+		b, err := json.Marshal(csa)
+		if err != nil {
+			return u, err
+		}
+		change["customSecurityAttributes"] = b
+	default:
+		change[a.UserUIDName] = raw
+	}
+	return u.Merge(User{Attributes: change})
+}
+
+// WithGroupGID returns g with its GID attribute set, used to record a GID written to Azure AD
+func (a IDAttributes) WithGroupGID(g Group, gid uint) (Group, error) {
+	raw := json.RawMessage(strconv.FormatUint(uint64(gid), 10))
+	return g.Merge(Group{Attributes: map[string]json.RawMessage{a.GroupGIDName: raw}})
+}
+
+// userAttribute returns the raw value of a user ID attribute from the configured source
+func (a IDAttributes) userAttribute(u User, name string) json.RawMessage {
+	switch a.Source {
+	case SourceSecurityAttributes:
+		return u.CustomSecurityAttributes[a.AttributeSet][name]
+	case SourceOnPremises:
+		return u.OnPremisesExtensionAttributes[name]
+	}
+	return u.Attributes[name]
+}
+
+// parseID decodes a numeric ID attribute stored as a JSON number or string
+func parseID(raw json.RawMessage) (id uint, ok bool, err error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, false, nil
+	}
+	var s string
+	if raw[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return 0, false, err
+		}
+	} else {
+		s = string(raw)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid ID attribute value %s: %w", raw, err)
+	}
+	return uint(n), true, nil
+}
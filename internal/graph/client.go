@@ -0,0 +1,222 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// DefaultBaseURL is the Microsoft Graph endpoint requests are made against
+const DefaultBaseURL = "https://graph.microsoft.com:443/"
+
+// DefaultMaxPages is the safety cap on @odata.nextLink pages followed per request
+const DefaultMaxPages = 500
+
+// Client makes authenticated requests against Microsoft Graph
+type Client struct {
+	BaseURL    string
+	Token      string
+	PageSize   int
+	MaxPages   int
+	HTTPClient *http.Client
+}
+
+// page is a single page of a Graph collection response
+type page struct {
+	Value     json.RawMessage `json:"value"`
+	NextLink  string          `json:"@odata.nextLink"`
+	DeltaLink string          `json:"@odata.deltaLink"`
+}
+
+// NewClient returns a client using token against the default Graph endpoint,
+// retrying throttled requests with the default RetryTransport
+func NewClient(token string) *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		Token:      token,
+		MaxPages:   DefaultMaxPages,
+		HTTPClient: &http.Client{Transport: NewRetryTransport()},
+	}
+}
+
+// Get requests a single object and decodes it into out
+func (c *Client) Get(req string, out interface{}) error {
+	body, err := c.do(http.MethodGet, c.url(req), nil, http.StatusOK, true)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unable to decode graph response: %w", err)
+	}
+	return nil
+}
+
+// GetUsers requests a collection of users, following @odata.nextLink
+func (c *Client) GetUsers(req string) ([]User, error) {
+	users := []User{}
+	err := c.getPages(req, func(value json.RawMessage) error {
+		var p []User
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		users = append(users, p...)
+		return nil
+	})
+	return users, err
+}
+
+// GetGroups requests a collection of groups, following @odata.nextLink
+func (c *Client) GetGroups(req string) ([]Group, error) {
+	groups := []Group{}
+	err := c.getPages(req, func(value json.RawMessage) error {
+		var p []Group
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		groups = append(groups, p...)
+		return nil
+	})
+	return groups, err
+}
+
+// GetMembers requests a collection of group members, following @odata.nextLink
+func (c *Client) GetMembers(req string) ([]Member, error) {
+	members := []Member{}
+	err := c.getPages(req, func(value json.RawMessage) error {
+		var p []Member
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		members = append(members, p...)
+		return nil
+	})
+	return members, err
+}
+
+// GetAppRoleAssignments requests a collection of app role assignments, following @odata.nextLink
+func (c *Client) GetAppRoleAssignments(req string) ([]AppRoleAssignment, error) {
+	assignments := []AppRoleAssignment{}
+	err := c.getPages(req, func(value json.RawMessage) error {
+		var p []AppRoleAssignment
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		assignments = append(assignments, p...)
+		return nil
+	})
+	return assignments, err
+}
+
+// Patch sends body as JSON to update an object. A 503 or 504 may come after
+// the update was made, so the request is only resent then when idempotent is
+// set: when writing the same values again cannot undo another writer's change.
+func (c *Client) Patch(req string, body interface{}, idempotent bool) error {
+	val, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(http.MethodPatch, c.url(req), val, http.StatusNoContent, idempotent)
+	return err
+}
+
+// getPages walks a collection response and hands each page's value list to fn
+func (c *Client) getPages(req string, fn func(json.RawMessage) error) error {
+
+	//Set page size on the first request, nextLink carries it through
+	if c.PageSize > 0 {
+		if strings.Contains(req, "?") {
+			req = req + "&$top=" + fmt.Sprint(c.PageSize)
+		} else {
+			req = req + "?$top=" + fmt.Sprint(c.PageSize)
+		}
+	}
+	_, err := c.walk(req, fn)
+	return err
+}
+
+// walk follows @odata.nextLink from req, handing each page's value list to fn,
+// and returns the @odata.deltaLink of the last page if there is one
+func (c *Client) walk(req string, fn func(json.RawMessage) error) (deltaLink string, err error) {
+	maxPages := c.MaxPages
+	if maxPages <= 0 {
+		maxPages = DefaultMaxPages
+	}
+
+	requestURL := c.url(req)
+	for n := 1; requestURL != ""; n++ {
+		if n > maxPages {
+			return "", fmt.Errorf("graph paging exceeded %d pages", maxPages)
+		}
+		body, err := c.do(http.MethodGet, requestURL, nil, http.StatusOK, true)
+		if err != nil {
+			return "", err
+		}
+		var p page
+		if err := json.Unmarshal(body, &p); err != nil {
+			return "", fmt.Errorf("unable to decode graph response: %w", err)
+		}
+		if len(p.Value) != 0 {
+			if err := fn(p.Value); err != nil {
+				return "", fmt.Errorf("unable to decode graph response: %w", err)
+			}
+		}
+		requestURL = p.NextLink
+		deltaLink = p.DeltaLink
+	}
+	return deltaLink, nil
+}
+
+// url joins a relative request onto the base URL, absolute links are used as-is
+func (c *Client) url(req string) string {
+	if strings.HasPrefix(req, "https://") || strings.HasPrefix(req, "http://") {
+		return req
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.TrimPrefix(req, "/")
+}
+
+// do performs a request and returns the body if the status matches expect.
+// GET requests are always resent after a server-side failure, others only
+// when marked idempotent.
+func (c *Client) do(method string, requestURL string, val []byte, expect int, idempotent bool) ([]byte, error) {
+	var reqBody *bytes.Reader
+	if val != nil {
+		reqBody = bytes.NewReader(val)
+	} else {
+		reqBody = bytes.NewReader([]byte{})
+	}
+	request, err := http.NewRequest(method, requestURL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	request.Header.Set("ConsistencyLevel", "eventual")
+	if val != nil {
+		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	if idempotent {
+		request = Idempotent(request)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	//Check if valid response
+	if res.StatusCode != expect {
+		return nil, newError(res.StatusCode, body)
+	}
+	return body, nil
+}
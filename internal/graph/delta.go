@@ -0,0 +1,77 @@
+package graph
+
+import (
+	"encoding/json"
+)
+
+// Removed marks an object or member that has left the result set of a delta query
+type Removed struct {
+	Reason string `json:"reason"`
+}
+
+// DeltaUsers runs a users delta query. req is either the initial query or the
+// deltaLink saved from the previous round. Changed users hold only the
+// properties that changed, removed users have Removed set.
+func (c *Client) DeltaUsers(req string) (users []User, deltaLink string, err error) {
+	users = []User{}
+	deltaLink, err = c.walk(req, func(value json.RawMessage) error {
+		var p []User
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		users = append(users, p...)
+		return nil
+	})
+	return users, deltaLink, err
+}
+
+// DeltaGroups runs a groups delta query. req is either the initial query or the
+// deltaLink saved from the previous round. Membership changes are returned in
+// MembersDelta, removed groups have Removed set.
+func (c *Client) DeltaGroups(req string) (groups []Group, deltaLink string, err error) {
+	groups = []Group{}
+	deltaLink, err = c.walk(req, func(value json.RawMessage) error {
+		var p []Group
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		groups = append(groups, p...)
+		return nil
+	})
+	return groups, deltaLink, err
+}
+
+// Merge applies the properties present in a delta change on top of u
+func (u User) Merge(change User) (User, error) {
+	var merged User
+	err := mergeAttributes(u.Attributes, change.Attributes, &merged)
+	return merged, err
+}
+
+// Merge applies the properties present in a delta change on top of g.
+// Membership changes are not merged, they are applied from MembersDelta.
+func (g Group) Merge(change Group) (Group, error) {
+	var merged Group
+	err := mergeAttributes(g.Attributes, change.Attributes, &merged)
+	return merged, err
+}
+
+// mergeAttributes overlays change onto base and decodes the result into out
+func mergeAttributes(base, change map[string]json.RawMessage, out interface{}) error {
+	attributes := map[string]json.RawMessage{}
+	for k, v := range base {
+		attributes[k] = v
+	}
+	for k, v := range change {
+		switch k {
+		case "@removed", "members@delta":
+			continue
+		}
+		attributes[k] = v
+	}
+	raw, err := json.Marshal(attributes)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
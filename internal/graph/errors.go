@@ -0,0 +1,82 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error is a failed Microsoft Graph request, decoded from the OData error body
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// odataError is the body Graph returns with a failed request
+type odataError struct {
+	Error struct {
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+		InnerError struct {
+			RequestID string `json:"request-id"`
+		} `json:"innerError"`
+	} `json:"error"`
+}
+
+// newError builds an Error from a failed response status and body
+func newError(status int, body []byte) *Error {
+	e := &Error{StatusCode: status}
+	var o odataError
+	if json.Unmarshal(body, &o) == nil {
+		e.Code = o.Error.Code
+		e.Message = o.Error.Message
+		e.RequestID = o.Error.InnerError.RequestID
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("graph request failed: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("graph request failed: %d %s: %s (request-id %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+// NotFound reports whether the requested object does not exist
+func (e *Error) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound || strings.HasSuffix(e.Code, "ResourceNotFound")
+}
+
+// Temporary reports whether the request may succeed if repeated later
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// ResyncRequired reports whether a delta token has expired and a full sync must be run
+func (e *Error) ResyncRequired() bool {
+	switch strings.ToLower(e.Code) {
+	case "resyncrequired", "syncstatenotfound", "syncstateinvalid":
+		return true
+	}
+	return e.StatusCode == http.StatusGone
+}
+
+// IsResyncRequired reports whether err is an expired delta token
+func IsResyncRequired(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.ResyncRequired()
+}
+
+// IsNotFound reports whether err is a Graph error for a missing object
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.NotFound()
+}
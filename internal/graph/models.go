@@ -0,0 +1,121 @@
+package graph
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// User is a Microsoft Graph user object
+type User struct {
+	ID                         string                   `json:"id"`
+	DisplayName                string                   `json:"displayName"`
+	UserPrincipalName          string                   `json:"userPrincipalName"`
+	LastPasswordChangeDateTime time.Time                `json:"lastPasswordChangeDateTime"`
+	OnPremisesSamAccountName   string                   `json:"onPremisesSamAccountName"`
+	MailNickname               string                   `json:"mailNickname"`
+	AccountEnabled             *bool                    `json:"accountEnabled"`
+	CustomSecurityAttributes   CustomSecurityAttributes `json:"customSecurityAttributes"`
+	//extensionAttribute1 to extensionAttribute15, synced from on-premises AD
+	OnPremisesExtensionAttributes map[string]json.RawMessage `json:"onPremisesExtensionAttributes"`
+	AssignedLicenses              []json.RawMessage          `json:"assignedLicenses"`
+	//Set on users removed since the last delta query
+	Removed *Removed `json:"@removed"`
+	//All returned properties, used to read directory extension attributes
+	Attributes map[string]json.RawMessage `json:"-"`
+}
+
+// Group is a Microsoft Graph group object with expanded members
+type Group struct {
+	ID                       string   `json:"id"`
+	DisplayName              string   `json:"displayName"`
+	MailNickname             string   `json:"mailNickname"`
+	OnPremisesSamAccountName string   `json:"onPremisesSamAccountName"`
+	SecurityEnabled          bool     `json:"securityEnabled"`
+	Members                  []Member `json:"members"`
+	//Membership changes since the last delta query
+	MembersDelta []Member `json:"members@delta"`
+	//Set on groups removed since the last delta query
+	Removed *Removed `json:"@removed"`
+	//All returned properties, used to read directory extension attributes
+	Attributes map[string]json.RawMessage `json:"-"`
+}
+
+// Member is a directory object returned in a group's members list
+type Member struct {
+	ODataType                string `json:"@odata.type"`
+	ID                       string `json:"id"`
+	UserPrincipalName        string `json:"userPrincipalName"`
+	OnPremisesSamAccountName string `json:"onPremisesSamAccountName"`
+	MailNickname             string `json:"mailNickname"`
+	AccountEnabled           *bool  `json:"accountEnabled"`
+	//Set on members removed since the last delta query
+	Removed *Removed `json:"@removed"`
+}
+
+// ServicePrincipal is the enterprise application of an app registration
+type ServicePrincipal struct {
+	ID       string    `json:"id"`
+	AppID    string    `json:"appId"`
+	AppRoles []AppRole `json:"appRoles"`
+}
+
+// AppRole is a role defined by an application
+type AppRole struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// AppRoleAssignment grants an app role to a user, group or service principal
+type AppRoleAssignment struct {
+	ID          string `json:"id"`
+	AppRoleID   string `json:"appRoleId"`
+	PrincipalID string `json:"principalId"`
+	ResourceID  string `json:"resourceId"`
+}
+
+// CustomSecurityAttributes maps attribute set names to their values
+type CustomSecurityAttributes map[string]AttributeSet
+
+// AttributeSet maps attribute names to raw values within a custom security attribute set
+type AttributeSet map[string]json.RawMessage
+
+// UnmarshalJSON decodes the known user fields and keeps every property for attribute lookup
+func (u *User) UnmarshalJSON(b []byte) error {
+	type user User
+	if err := json.Unmarshal(b, (*user)(u)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &u.Attributes)
+}
+
+// UnmarshalJSON decodes the known group fields and keeps every property for attribute lookup
+func (g *Group) UnmarshalJSON(b []byte) error {
+	type group Group
+	if err := json.Unmarshal(b, (*group)(g)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &g.Attributes)
+}
+
+// IsUser reports whether the member is a user object
+func (m Member) IsUser() bool {
+	return m.ODataType == "#microsoft.graph.user" || (m.ODataType == "" && m.UserPrincipalName != "")
+}
+
+// MarshalJSON encodes every property the user was decoded with
+func (u User) MarshalJSON() ([]byte, error) {
+	if u.Attributes != nil {
+		return json.Marshal(u.Attributes)
+	}
+	type user User
+	return json.Marshal(user(u))
+}
+
+// MarshalJSON encodes every property the group was decoded with
+func (g Group) MarshalJSON() ([]byte, error) {
+	if g.Attributes != nil {
+		return json.Marshal(g.Attributes)
+	}
+	type group Group
+	return json.Marshal(group(g))
+}
@@ -0,0 +1,152 @@
+package graph
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default retry settings for throttled Graph requests
+const (
+	DefaultMaxRetries  = 5
+	DefaultBaseDelay   = 500 * time.Millisecond
+	DefaultMaxDelay    = 30 * time.Second
+	DefaultRetryBudget = 60 * time.Second
+)
+
+type idempotentKey struct{}
+
+// Idempotent marks a request as safe to resend after a server-side failure.
+// GET requests are always treated as idempotent.
+func Idempotent(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), idempotentKey{}, true))
+}
+
+// RetryTransport retries throttled and temporarily unavailable Graph requests,
+// honouring Retry-After and otherwise backing off exponentially with jitter
+type RetryTransport struct {
+	Base       http.RoundTripper
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	//Total time allowed across all attempts of a single request
+	Budget time.Duration
+}
+
+// NewRetryTransport returns a retrying transport with default settings
+func NewRetryTransport() *RetryTransport {
+	return &RetryTransport{
+		Base:       http.DefaultTransport,
+		MaxRetries: DefaultMaxRetries,
+		BaseDelay:  DefaultBaseDelay,
+		MaxDelay:   DefaultMaxDelay,
+		Budget:     DefaultRetryBudget,
+	}
+}
+
+// RoundTrip sends the request, retrying where the status and method allow it
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	deadline := time.Now().Add(t.Budget)
+
+	for attempt := 0; ; attempt++ {
+		//Resend a copy with a fresh body, the caller's request is left alone
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+		res, err := base.RoundTrip(attemptReq)
+
+		if attempt >= t.MaxRetries || !t.retryable(req, res, err) {
+			return res, err
+		}
+
+		//Work out how long to wait, giving up if it would exceed the budget
+		delay := t.backoff(attempt)
+		if res != nil {
+			if after, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+				delay = after
+			}
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return res, err
+		}
+		if res != nil {
+			//Drain so the connection can be reused
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a failed attempt may be resent
+func (t *RetryTransport) retryable(req *http.Request, res *http.Response, err error) bool {
+	idempotent := req.Method == http.MethodGet || req.Context().Value(idempotentKey{}) != nil
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		//Body cannot be replayed
+		return false
+	}
+	if err != nil {
+		return idempotent && req.Context().Err() == nil
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		//Throttled requests were rejected before being processed
+		return true
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// backoff returns the jittered exponential delay before the next attempt
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	delay := t.BaseDelay << uint(attempt)
+	if delay <= 0 || delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+	//Full jitter across the upper half of the window
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(v); err == nil {
+		d := time.Until(when)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,227 @@
+package graph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// retryServer answers each request with the next of statuses, repeating the
+// last, and records the bodies it was sent
+type retryServer struct {
+	statuses   []int
+	retryAfter string
+	bodies     []string
+}
+
+func (s *retryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.bodies = append(s.bodies, string(body))
+	status := s.statuses[len(s.statuses)-1]
+	if len(s.bodies) <= len(s.statuses) {
+		status = s.statuses[len(s.bodies)-1]
+	}
+	if status != http.StatusOK && status != http.StatusNoContent && s.retryAfter != "" {
+		w.Header().Set("Retry-After", s.retryAfter)
+	}
+	w.WriteHeader(status)
+}
+
+// newRetryClient returns a client sending through a RetryTransport to s,
+// backing off for baseDelay between attempts without Retry-After
+func newRetryClient(t *testing.T, s *retryServer, baseDelay time.Duration, budget time.Duration) (*http.Client, string) {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	transport := &RetryTransport{
+		Base:       srv.Client().Transport,
+		MaxRetries: DefaultMaxRetries,
+		BaseDelay:  baseDelay,
+		MaxDelay:   baseDelay,
+		Budget:     budget,
+	}
+	return &http.Client{Transport: transport}, srv.URL
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		ok       bool
+		min, max time.Duration
+	}{
+		{"seconds", "3", true, 3 * time.Second, 3 * time.Second},
+		{"zero", "0", true, 0, 0},
+		{"http date", time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), true, 8 * time.Second, 10 * time.Second},
+		{"past http date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), true, 0, 0},
+		{"missing", "", false, 0, 0},
+		{"negative", "-1", false, 0, 0},
+		{"invalid", "soon", false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := retryAfter(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("retryAfter(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+			}
+			if d < tt.min || d > tt.max {
+				t.Errorf("retryAfter(%q) = %v, want %v to %v", tt.value, d, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+// Throttled requests wait for Retry-After in place of the much longer backoff
+func TestRetryThrottled(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+	}{
+		{"seconds", "0"},
+		{"http date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &retryServer{statuses: []int{429, 429, 200}, retryAfter: tt.retryAfter}
+			client, url := newRetryClient(t, s, time.Hour, time.Minute)
+
+			res, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("got status %d, want 200", res.StatusCode)
+			}
+			if len(s.bodies) != 3 {
+				t.Errorf("sent %d requests, want 3", len(s.bodies))
+			}
+		})
+	}
+}
+
+// A Retry-After beyond the budget is not waited for, the throttled response is returned
+func TestRetryBudgetExhausted(t *testing.T) {
+	s := &retryServer{statuses: []int{429}, retryAfter: "120"}
+	client, url := newRetryClient(t, s, time.Millisecond, time.Second)
+
+	start := time.Now()
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want 429", res.StatusCode)
+	}
+	if len(s.bodies) != 1 {
+		t.Errorf("sent %d requests, want 1", len(s.bodies))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want no wait", elapsed)
+	}
+}
+
+// A 503 may come after the request was processed, only idempotent requests are resent
+func TestRetryUnavailable(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		mark     bool
+		requests int
+		status   int
+	}{
+		{"GET", http.MethodGet, false, 2, http.StatusOK},
+		{"POST", http.MethodPost, false, 1, http.StatusServiceUnavailable},
+		{"idempotent PATCH", http.MethodPatch, true, 2, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &retryServer{statuses: []int{503, 200}}
+			client, url := newRetryClient(t, s, time.Millisecond, time.Minute)
+
+			body := `{"gidNumber":50000}`
+			req, err := http.NewRequest(tt.method, url, bytes.NewReader([]byte(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.mark {
+				req = Idempotent(req)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", res.StatusCode, tt.status)
+			}
+			if len(s.bodies) != tt.requests {
+				t.Fatalf("sent %d requests, want %d", len(s.bodies), tt.requests)
+			}
+			//Every attempt carries the whole body
+			for i, got := range s.bodies {
+				if tt.method != http.MethodGet && got != body {
+					t.Errorf("attempt %d sent body %q, want %q", i+1, got, body)
+				}
+			}
+		})
+	}
+}
+
+// Client.Patch only resends a PATCH marked idempotent, with the same body
+func TestPatchRetried(t *testing.T) {
+	tests := []struct {
+		name       string
+		idempotent bool
+		want       []string
+	}{
+		{"idempotent", true, []string{`{"gidNumber":50000}`, `{"gidNumber":50000}`}},
+		{"not idempotent", false, []string{`{"gidNumber":50000}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &retryServer{statuses: []int{503, 204}}
+			httpClient, url := newRetryClient(t, s, time.Millisecond, time.Minute)
+			c := &Client{BaseURL: url, HTTPClient: httpClient}
+
+			err := c.Patch("v1.0/groups/g", map[string]uint{"gidNumber": 50000}, tt.idempotent)
+			if tt.idempotent && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.idempotent && err == nil {
+				t.Error("got no error, want the 503")
+			}
+			if !reflect.DeepEqual(s.bodies, tt.want) {
+				t.Errorf("sent bodies %q, want %q", s.bodies, tt.want)
+			}
+		})
+	}
+}
+
+// Retries are sent as copies, the caller's request is not changed
+func TestRetryLeavesRequest(t *testing.T) {
+	s := &retryServer{statuses: []int{429, 200}, retryAfter: "0"}
+	client, url := newRetryClient(t, s, time.Millisecond, time.Minute)
+
+	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+	res, err := client.Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(s.bodies) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(s.bodies))
+	}
+	if req.Body != body {
+		t.Error("request body was replaced")
+	}
+}
@@ -0,0 +1,41 @@
+package logger
+
+import (
+	"io/ioutil"
+	"log"
+	"log/syslog"
+)
+
+// Loggers shared by the modules and internal packages. They discard output until Init is called.
+var Debug = log.New(ioutil.Discard, "DEBUG:", log.Lshortfile)
+var Info = log.New(ioutil.Discard, "INFO:", log.Lshortfile)
+var Warn = log.New(ioutil.Discard, "WARN:", log.Lshortfile)
+var Error = log.New(ioutil.Discard, "ERROR:", log.Lshortfile)
+
+// Init sends the shared loggers to syslog tagged with app
+func Init(app string) {
+	debugL, err := syslog.New(syslog.LOG_DEBUG, app)
+	if err != nil {
+		log.Fatalf("Failed to open Debug logger")
+	}
+
+	infoL, err := syslog.New(syslog.LOG_INFO, app)
+	if err != nil {
+		log.Fatalf("Failed to open Info logger")
+	}
+
+	warnL, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_WARNING, app)
+	if err != nil {
+		log.Fatalf("Failed to open Warn logger")
+	}
+
+	errorL, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_ERR, app)
+	if err != nil {
+		log.Fatalf("Failed to open Error logger")
+	}
+
+	Debug.SetOutput(debugL)
+	Info.SetOutput(infoL)
+	Warn.SetOutput(warnL)
+	Error.SetOutput(errorL)
+}
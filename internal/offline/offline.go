@@ -0,0 +1,205 @@
+package offline
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for new verifiers, stored with each verifier so they can be raised later
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+	saltLen      = 16
+)
+
+var (
+	// ErrNoVerifier is returned when the user has never logged in online on this host
+	ErrNoVerifier = errors.New("no offline verifier for user")
+	// ErrExpired is returned when the user has not logged in online within MaxAge
+	ErrExpired = errors.New("offline verifier expired")
+	// ErrLocked is returned once MaxFailures wrong passwords have been tried offline
+	ErrLocked = errors.New("offline login locked after too many failures")
+	// ErrMismatch is returned for a wrong password
+	ErrMismatch = errors.New("password does not match offline verifier")
+)
+
+// Store holds password verifiers for offline logins. The store is readable by root only.
+type Store struct {
+	Dir string
+	//Verifiers older than MaxAge are not accepted, zero never expires
+	MaxAge time.Duration
+	//Wrong passwords allowed offline before the user must log in online again, zero is unlimited
+	MaxFailures int
+}
+
+// verifier is an argon2id hash of a user's password
+type verifier struct {
+	Salt    []byte    `json:"salt"`
+	Hash    []byte    `json:"hash"`
+	Time    uint32    `json:"time"`
+	Memory  uint32    `json:"memory"`
+	Threads uint8     `json:"threads"`
+	Updated time.Time `json:"updated"`
+	//Wrong offline passwords since the last successful login
+	Failures int `json:"failures"`
+}
+
+// New returns a store kept in dir
+func New(dir string, maxAge time.Duration, maxFailures int) *Store {
+	return &Store{Dir: dir, MaxAge: maxAge, MaxFailures: maxFailures}
+}
+
+// Save records password as the offline verifier for user. Only call this once
+// Azure AD has accepted the password.
+func (s *Store) Save(user string, password string) error {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	v := verifier{
+		Salt:    salt,
+		Hash:    argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen),
+		Time:    argonTime,
+		Memory:  argonMemory,
+		Threads: argonThreads,
+		Updated: time.Now(),
+	}
+	return s.update(func(verifiers map[string]verifier) (bool, error) {
+		verifiers[user] = v
+		return true, nil
+	})
+}
+
+// Verify checks password against the offline verifier for user. Wrong passwords
+// count towards MaxFailures, a correct one resets the count.
+func (s *Store) Verify(user string, password string) error {
+	return s.update(func(verifiers map[string]verifier) (bool, error) {
+		v, err := s.usable(verifiers, user)
+		if err != nil {
+			return false, err
+		}
+		hash := argon2.IDKey([]byte(password), v.Salt, v.Time, v.Memory, v.Threads, uint32(len(v.Hash)))
+		if subtle.ConstantTimeCompare(hash, v.Hash) != 1 {
+			v.Failures++
+			verifiers[user] = v
+			return true, ErrMismatch
+		}
+		if v.Failures == 0 {
+			return false, nil
+		}
+		v.Failures = 0
+		verifiers[user] = v
+		return true, nil
+	})
+}
+
+// Usable reports whether user has a verifier that would be checked offline,
+// nil when they have one that is neither expired nor locked
+func (s *Store) Usable(user string) error {
+	return s.update(func(verifiers map[string]verifier) (bool, error) {
+		_, err := s.usable(verifiers, user)
+		return false, err
+	})
+}
+
+// usable returns the verifier for user if it would be checked offline
+func (s *Store) usable(verifiers map[string]verifier, user string) (verifier, error) {
+	v, ok := verifiers[user]
+	if !ok {
+		return v, ErrNoVerifier
+	}
+	if s.MaxAge > 0 && time.Since(v.Updated) > s.MaxAge {
+		return v, ErrExpired
+	}
+	if s.MaxFailures > 0 && v.Failures >= s.MaxFailures {
+		return v, ErrLocked
+	}
+	return v, nil
+}
+
+// Forget removes the verifier for user, so they cannot log in offline until
+// they next log in online
+func (s *Store) Forget(user string) error {
+	return s.update(func(verifiers map[string]verifier) (bool, error) {
+		if _, ok := verifiers[user]; !ok {
+			return false, nil
+		}
+		delete(verifiers, user)
+		return true, nil
+	})
+}
+
+// update applies fn to the verifiers under an exclusive lock and, when fn
+// reports it changed them, writes them back atomically. The error from fn is
+// returned, changes are saved whether or not it failed so failure counts persist.
+func (s *Store) update(fn func(map[string]verifier) (changed bool, err error)) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(s.path()+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	verifiers := map[string]verifier{}
+	data, err := ioutil.ReadFile(s.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &verifiers); err != nil {
+			return err
+		}
+	}
+
+	changed, result := fn(verifiers)
+	if !changed {
+		return result
+	}
+
+	data, err = json.Marshal(verifiers)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.Dir, ".verifiers.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path()); err != nil {
+		return err
+	}
+	return result
+}
+
+// path returns the file holding the verifiers
+func (s *Store) path() string {
+	return filepath.Join(s.Dir, "verifiers.json")
+}
@@ -0,0 +1,148 @@
+package offline
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// unchanged fails t if the verifier file was written since info was taken
+func unchanged(t *testing.T, s *Store, info os.FileInfo, action string) {
+	t.Helper()
+	now, err := os.Stat(s.path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !now.ModTime().Equal(info.ModTime()) || now.Size() != info.Size() {
+		t.Errorf("%s rewrote the verifier file", action)
+	}
+}
+
+func TestSaveVerify(t *testing.T) {
+	s := New(t.TempDir(), 0, 0)
+	if err := s.Verify("alice", "secret"); !errors.Is(err, ErrNoVerifier) {
+		t.Errorf("Verify before Save got %v, want ErrNoVerifier", err)
+	}
+	if err := s.Save("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(s.path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("verifier file mode %o, want 600", mode)
+	}
+
+	if err := s.Verify("alice", "secret"); err != nil {
+		t.Errorf("Verify with the saved password got %v", err)
+	}
+	unchanged(t, s, info, "a successful Verify")
+	if err := s.Verify("alice", "wrong"); !errors.Is(err, ErrMismatch) {
+		t.Errorf("Verify with a wrong password got %v, want ErrMismatch", err)
+	}
+	if err := s.Verify("bob", "secret"); !errors.Is(err, ErrNoVerifier) {
+		t.Errorf("Verify for another user got %v, want ErrNoVerifier", err)
+	}
+
+	//Saving again replaces the password
+	if err := s.Save("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify("alice", "secret"); !errors.Is(err, ErrMismatch) {
+		t.Errorf("Verify with the old password got %v, want ErrMismatch", err)
+	}
+	if err := s.Verify("alice", "changed"); err != nil {
+		t.Errorf("Verify with the new password got %v", err)
+	}
+}
+
+// Wrong passwords lock the verifier at MaxFailures, a correct one before then resets the count
+func TestVerifyFailures(t *testing.T) {
+	s := New(t.TempDir(), 0, 2)
+	if err := s.Save("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	s.Verify("alice", "wrong")
+	if err := s.Verify("alice", "secret"); err != nil {
+		t.Fatalf("Verify after one failure got %v", err)
+	}
+	s.Verify("alice", "wrong")
+	s.Verify("alice", "wrong")
+	if err := s.Verify("alice", "secret"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Verify after MaxFailures got %v, want ErrLocked", err)
+	}
+	if err := s.Usable("alice"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Usable after MaxFailures got %v, want ErrLocked", err)
+	}
+
+	//Logging in online saves a new verifier, unlocking it
+	if err := s.Save("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify("alice", "secret"); err != nil {
+		t.Errorf("Verify after Save got %v", err)
+	}
+}
+
+func TestUsable(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		user   string
+		want   error
+	}{
+		{"usable", 0, "alice", nil},
+		{"unknown user", 0, "bob", ErrNoVerifier},
+		{"expired", time.Nanosecond, "alice", ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(t.TempDir(), tt.maxAge, 0)
+			if err := s.Save("alice", "secret"); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(s.path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Usable(tt.user); !errors.Is(err, tt.want) {
+				t.Errorf("Usable got %v, want %v", err, tt.want)
+			}
+			unchanged(t, s, info, "Usable")
+			if tt.want == ErrExpired {
+				if err := s.Verify("alice", "secret"); !errors.Is(err, ErrExpired) {
+					t.Errorf("Verify got %v, want ErrExpired", err)
+				}
+			}
+		})
+	}
+}
+
+func TestForget(t *testing.T) {
+	s := New(t.TempDir(), 0, 0)
+	for _, user := range []string{"alice", "bob"} {
+		if err := s.Save(user, "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Forget("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Usable("alice"); !errors.Is(err, ErrNoVerifier) {
+		t.Errorf("Usable after Forget got %v, want ErrNoVerifier", err)
+	}
+	if err := s.Verify("bob", "secret"); err != nil {
+		t.Errorf("Verify for another user after Forget got %v", err)
+	}
+
+	info, err := os.Stat(s.path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Forget("alice"); err != nil {
+		t.Fatal(err)
+	}
+	unchanged(t, s, info, "forgetting a user without a verifier")
+}
@@ -0,0 +1,166 @@
+package syncd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/datty/pam-azuread/internal/directory"
+
+	nssStructs "github.com/protosam/go-libnss/structs"
+)
+
+// DefaultSocket is where azuread-syncd listens for lookups
+const DefaultSocket = "/run/azuread/syncd.sock"
+
+// Lookup operations, named after the libc calls they answer
+const (
+	OpPasswdAll    = "getpwent"
+	OpPasswdByName = "getpwnam"
+	OpPasswdByUid  = "getpwuid"
+	OpGroupAll     = "getgrent"
+	OpGroupByName  = "getgrnam"
+	OpGroupByGid   = "getgrgid"
+	OpInitGroups   = "initgroups"
+	OpShadowAll    = "getspent"
+	OpShadowByName = "getspnam"
+)
+
+// Request is a single lookup sent as one line of JSON
+type Request struct {
+	Op   string `json:"op"`
+	Name string `json:"name,omitempty"`
+	ID   uint   `json:"id,omitempty"`
+}
+
+// Response answers a Request, holding entries for the requested database
+type Response struct {
+	Status directory.Status    `json:"status"`
+	Passwd []nssStructs.Passwd `json:"passwd,omitempty"`
+	Group  []nssStructs.Group  `json:"group,omitempty"`
+	Shadow []nssStructs.Shadow `json:"shadow,omitempty"`
+	//GIDs of a user's groups, answering OpInitGroups
+	GIDs []uint `json:"gids,omitempty"`
+}
+
+// Client sends lookups to azuread-syncd
+type Client struct {
+	Socket  string
+	Timeout time.Duration
+}
+
+// NewClient returns a client for the daemon listening on socket
+func NewClient(socket string) *Client {
+	if socket == "" {
+		socket = DefaultSocket
+	}
+	return &Client{Socket: socket, Timeout: 10 * time.Second}
+}
+
+// Do sends req and waits for the response. A daemon that cannot be reached
+// is reported as StatusUnavail so NSS moves on to the next source.
+func (c *Client) Do(req Request) (Response, error) {
+	conn, err := net.DialTimeout("unix", c.Socket, c.Timeout)
+	if err != nil {
+		return Response{Status: directory.StatusUnavail}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Response{Status: directory.StatusUnavail}, err
+	}
+	var res Response
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&res); err != nil {
+		return Response{Status: directory.StatusUnavail}, fmt.Errorf("invalid response from %s: %w", c.Socket, err)
+	}
+	return res, nil
+}
+
+// PasswdAll returns every passwd entry known to the daemon
+func (c *Client) PasswdAll() ([]nssStructs.Passwd, error) {
+	res, err := c.do(Request{Op: OpPasswdAll})
+	return res.Passwd, err
+}
+
+// PasswdByName returns the passwd entry for name
+func (c *Client) PasswdByName(name string) (nssStructs.Passwd, error) {
+	res, err := c.do(Request{Op: OpPasswdByName, Name: name})
+	if err != nil || len(res.Passwd) == 0 {
+		return nssStructs.Passwd{}, notFound(err)
+	}
+	return res.Passwd[0], nil
+}
+
+// PasswdByUid returns the passwd entry for uid
+func (c *Client) PasswdByUid(uid uint) (nssStructs.Passwd, error) {
+	res, err := c.do(Request{Op: OpPasswdByUid, ID: uid})
+	if err != nil || len(res.Passwd) == 0 {
+		return nssStructs.Passwd{}, notFound(err)
+	}
+	return res.Passwd[0], nil
+}
+
+// GroupAll returns every group known to the daemon
+func (c *Client) GroupAll() ([]nssStructs.Group, error) {
+	res, err := c.do(Request{Op: OpGroupAll})
+	return res.Group, err
+}
+
+// GroupByName returns the group called name
+func (c *Client) GroupByName(name string) (nssStructs.Group, error) {
+	res, err := c.do(Request{Op: OpGroupByName, Name: name})
+	if err != nil || len(res.Group) == 0 {
+		return nssStructs.Group{}, notFound(err)
+	}
+	return res.Group[0], nil
+}
+
+// GroupByGid returns the group with gid
+func (c *Client) GroupByGid(gid uint) (nssStructs.Group, error) {
+	res, err := c.do(Request{Op: OpGroupByGid, ID: gid})
+	if err != nil || len(res.Group) == 0 {
+		return nssStructs.Group{}, notFound(err)
+	}
+	return res.Group[0], nil
+}
+
+// InitGroups returns the GIDs of the groups name belongs to
+func (c *Client) InitGroups(name string) ([]uint, error) {
+	res, err := c.do(Request{Op: OpInitGroups, Name: name})
+	return res.GIDs, err
+}
+
+// ShadowAll returns every shadow entry, the daemon only answers root
+func (c *Client) ShadowAll() ([]nssStructs.Shadow, error) {
+	res, err := c.do(Request{Op: OpShadowAll})
+	return res.Shadow, err
+}
+
+// ShadowByName returns the shadow entry for name, the daemon only answers root
+func (c *Client) ShadowByName(name string) (nssStructs.Shadow, error) {
+	res, err := c.do(Request{Op: OpShadowByName, Name: name})
+	if err != nil || len(res.Shadow) == 0 {
+		return nssStructs.Shadow{}, notFound(err)
+	}
+	return res.Shadow[0], nil
+}
+
+// do sends req and turns an unsuccessful status into an error
+func (c *Client) do(req Request) (Response, error) {
+	res, err := c.Do(req)
+	if err != nil {
+		return res, fmt.Errorf("azuread-syncd unavailable: %w", err)
+	}
+	return res, res.Status.Err()
+}
+
+// notFound returns err, or ErrNotFound for a successful but empty response
+func notFound(err error) error {
+	if err != nil {
+		return err
+	}
+	return directory.ErrNotFound
+}